@@ -24,7 +24,12 @@ func main() {
 		log.Fatal("migrate error - ", err)
 	}
 
-	customerHandler := customer.Handler{DB: db}
+	compression, err := shared.CompressionFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	customerHandler := customer.Handler{DB: db, Compression: compression}
 
 	app := fiber.New()
 
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	workerhandlers "outbox/cmd/worker/handlers"
+	worker2handlers "outbox/cmd/worker2/handlers"
+	"outbox/database"
+	"outbox/shared"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// registries builds the handler registry of each consumer, used to check which events are replay safe.
+// They must register the same handlers as the consumer's cmd.
+var registries = map[string]func() *shared.HandlerRegistry{
+	"worker": func() *shared.HandlerRegistry {
+		r := shared.NewHandlerRegistry(shared.IgnoreUnknownEvents)
+		(&workerhandlers.CustomerHandler{}).Register(r)
+		return r
+	},
+	"worker2": func() *shared.HandlerRegistry {
+		r := shared.NewHandlerRegistry(shared.IgnoreUnknownEvents)
+		(&worker2handlers.CustomerHandler{}).Register(r)
+		return r
+	},
+}
+
+// inboxctl resets processed or parked inbox messages so the worker processes them again, e.g.
+//
+//	inboxctl -consumer worker -event CustomerCreated -from 2024-01-01T00:00:00Z -dry-run
+func main() {
+	consumer := flag.String("consumer", "", "consumer whose inbox messages are replayed, e.g. worker")
+	events := flag.String("event", "", "comma separated event names")
+	from := flag.String("from", "", "replay messages received at or after this RFC3339 time")
+	to := flag.String("to", "", "replay messages received before this RFC3339 time")
+	ids := flag.String("id", "", "comma separated inbox message IDs")
+	dryRun := flag.Bool("dry-run", false, "list the messages that would be replayed without changing them")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("loading env file: ", err)
+	}
+
+	newRegistry, ok := registries[*consumer]
+	if !ok {
+		log.Fatalf("unknown consumer %q", *consumer)
+	}
+
+	filter := shared.ReplayFilter{
+		Consumer:   *consumer,
+		EventNames: splitList(*events),
+		IDs:        splitList(*ids),
+	}
+
+	var err error
+	if filter.From, err = parseTime(*from); err != nil {
+		log.Fatal("invalid -from: ", err)
+	}
+	if filter.To, err = parseTime(*to); err != nil {
+		log.Fatal("invalid -to: ", err)
+	}
+
+	db, err := database.NewConnection()
+	if err != nil {
+		log.Fatal("error connecting to db: ", err)
+	}
+
+	messages, err := shared.ReplayMessages(db, newRegistry(), filter, *dryRun)
+	if err != nil {
+		log.Fatal("replay error: ", err)
+	}
+
+	for _, msg := range messages {
+		fmt.Printf("%s\t%s\t%s\t%s\n", msg.ID, msg.EventName, msg.Status, msg.ReceivedAt.Format(time.RFC3339))
+	}
+
+	if *dryRun {
+		fmt.Printf("%d messages would be replayed\n", len(messages))
+		return
+	}
+	fmt.Printf("%d messages replayed\n", len(messages))
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"outbox/queue"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// queuectl runs RabbitMQ maintenance tasks:
+//
+//	queuectl cleanup -prefix worker2_queue_ -dry-run
+//	queuectl diff -worker-queues worker_queue,worker2_queue
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatal("usage: queuectl cleanup|diff [flags]")
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("loading env file: ", err)
+	}
+
+	switch os.Args[1] {
+	case "cleanup":
+		cleanup(os.Args[2:])
+	case "diff":
+		diff(os.Args[2:])
+	default:
+		log.Fatalf("unknown command %q", os.Args[1])
+	}
+}
+
+// cleanup deletes the per-instance queues left behind by workers before they shared a queue per consumer group
+func cleanup(args []string) {
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	prefix := flags.String("prefix", "worker2_queue_", "delete queues starting with this prefix")
+	vhost := flags.String("vhost", defaultVhost(), "RabbitMQ vhost")
+	dryRun := flags.Bool("dry-run", false, "list the queues that would be deleted without deleting them")
+	_ = flags.Parse(args)
+
+	orphaned, err := queue.FindOrphanedQueues(queue.NewManagementClientFromEnv(), *vhost, *prefix)
+	if err != nil {
+		log.Fatal("list queues error: ", err)
+	}
+
+	for _, q := range orphaned {
+		fmt.Printf("%s\t%d messages\n", q.Name, q.Messages)
+	}
+
+	if *dryRun || len(orphaned) == 0 {
+		fmt.Printf("%d orphaned queues found\n", len(orphaned))
+		return
+	}
+
+	conn, err := queue.CreateConnection()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeConnection(conn)
+
+	ch, err := queue.CreateChannel(conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeConnection(ch)
+
+	dropped, err := queue.DeleteQueues(ch, orphaned)
+	if err != nil {
+		log.Fatal("delete queues error: ", err)
+	}
+	fmt.Printf("%d orphaned queues deleted, %d messages dropped\n", len(orphaned), dropped)
+}
+
+// diff compares the topology the relay and workers declare with the live broker
+func diff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	workerQueues := flags.String("worker-queues", "worker_queue,worker2_queue", "comma separated worker queue names")
+	retryDelays := flags.String("retry-delays", os.Getenv("CONSUMER_RETRY_DELAYS"), "comma separated worker retry delays")
+	exchangeType := flags.String("exchange-type", os.Getenv("OUTBOX_EXCHANGE_TYPE"), "outbox exchange type, fanout or topic")
+	routingKeys := flags.String("routing-keys", "customer.created", "comma separated routing keys worker queues are bound with on a topic exchange")
+	maxPriority := flags.Uint("max-priority", 0, "x-max-priority of worker queues, 0 for plain queues")
+	queueType := flags.String("queue-type", os.Getenv("CONSUMER_QUEUE_TYPE"), "worker queue type, classic, quorum or stream")
+	deliveryLimit := flags.Int("delivery-limit", 0, "x-delivery-limit of quorum worker queues")
+	deduplication := flags.Bool("deduplication", false, "worker queues are declared with x-message-deduplication")
+	vhost := flags.String("vhost", defaultVhost(), "RabbitMQ vhost")
+	_ = flags.Parse(args)
+
+	delays, err := queue.ParseRetryDelays(*retryDelays)
+	if err != nil {
+		log.Fatal("invalid -retry-delays: ", err)
+	}
+
+	exchange, err := queue.OutboxExchangeOfType(*exchangeType)
+	if err != nil {
+		log.Fatal("invalid -exchange-type: ", err)
+	}
+
+	topology := queue.RelayTopology(exchange)
+	for _, queueName := range splitList(*workerQueues) {
+		topology = topology.Merge(queue.WorkerTopology(queue.WorkerQueue{
+			Name:          queueName,
+			Exchange:      exchange,
+			RoutingKeys:   splitList(*routingKeys),
+			RetryDelays:   delays,
+			MaxPriority:   uint8(*maxPriority),
+			Type:          *queueType,
+			DeliveryLimit: *deliveryLimit,
+			Deduplication: *deduplication,
+		}))
+	}
+
+	diffs, err := topology.Diff(queue.NewManagementClientFromEnv(), *vhost)
+	if err != nil {
+		log.Fatal("diff topology error: ", err)
+	}
+
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("broker matches the topology")
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// defaultVhost is RABBITMQ_VHOST, or "/" when unset
+func defaultVhost() string {
+	if vhost := os.Getenv("RABBITMQ_VHOST"); vhost != "" {
+		return vhost
+	}
+	return "/"
+}
+
+func closeConnection(c io.Closer) {
+	if err := c.Close(); err != nil {
+		log.Println(err)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -19,85 +21,85 @@ func main() {
 		log.Println("loading env file: ", err)
 	}
 
-	db, err := database.NewConnection()
-	if err != nil {
-		log.Fatal("error connecting to db")
+	if err := run(); err != nil {
+		log.Fatal(err)
 	}
+}
 
-	conn, err := queue.CreateConnection()
+// run starts the relay and blocks until it is stopped. Errors are returned instead of calling
+// log.Fatal so the deferred closes still run.
+func run() error {
+	db, err := database.NewConnection()
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("error connecting to db: %w", err)
 	}
-	defer closeConnection(conn)
 
-	ch, err := queue.CreateChannel(conn)
+	// How long to wait for in-flight work on SIGTERM
+	shutdownTimeout, err := shared.ShutdownTimeoutFromEnv()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer closeConnection(ch)
-
-	// Declare a fanout exchange
-	exchangeName := "outbox_events"
-	err = ch.ExchangeDeclare(
-		exchangeName, // name
-		"fanout",     // type
-		true,         // durable
-		false,        // auto-deleted
-		false,        // internal
-		false,        // no-wait
-		nil,          // arguments
-	)
+
+	// Fail fast on a broken RabbitMQ config instead of retrying the connection forever
+	rabbitConfig, err := queue.LoadConfig()
 	if err != nil {
-		log.Fatalf("Failed to declare exchange: %v", err)
+		return fmt.Errorf("invalid RabbitMQ config: %w", err)
 	}
 
-	// The queue declaration is still needed for compatibility
-	// Worker services will bind their own queues to this exchange
-	q, err := ch.QueueDeclare(
-		"outbox_fanout", // name (can be empty for exclusive queues)
-		true,            // durable
-		false,           // delete when unused
-		false,           // exclusive
-		false,           // no-wait
-		nil,             // arguments
-	)
+	// Publish to the fanout or topic exchange selected by OUTBOX_EXCHANGE_TYPE
+	exchange, err := queue.OutboxExchangeFromEnv()
 	if err != nil {
-		log.Fatalf("Failed to declare queue: %v", err)
+		return err
 	}
 
-	// Bind the queue to the exchange
-	err = ch.QueueBind(
-		q.Name,       // queue name
-		"",           // routing key - empty for fanout
-		exchangeName, // exchange
-		false,        // no-wait
-		nil,          // arguments
-	)
-	if err != nil {
-		log.Fatalf("Failed to bind queue: %v", err)
+	// Connect to RabbitMQ and declare the outbox exchange, reconnecting whenever the connection is lost
+	connection := &queue.ConnectionManager{
+		Dial:          rabbitConfig.Dial,
+		Topology:      queue.RelayTopology(exchange),
+		OnStateChange: queue.LogStateChange,
+	}
+	if err := connection.Start(); err != nil {
+		return err
 	}
+	defer closeConnection(connection)
 
 	jobProcessor := shared.OutboxProcessor{
 		DB:           db,
-		Channel:      ch,
-		Queue:        q,
-		Exchange:     exchangeName,
-		ExchangeType: "fanout",
+		Channels:     connection,
+		Exchange:     exchange.Name,
+		ExchangeType: exchange.Type,
+	}
+	if err := jobProcessor.ConfigureFromEnv(); err != nil {
+		return err
 	}
 
 	c := cron.New()
 	_, err = c.AddFunc("@every 10s", jobProcessor.HandleOutboxMessage)
 	if err != nil {
-		log.Fatal("register handler error", err)
+		return fmt.Errorf("register handler error: %w", err)
 	}
-	log.Printf("Start processing outbox messages with fanout exchange: %s", exchangeName)
+	log.Printf("Start processing outbox messages with %s exchange: %s", exchange.Type, exchange.Name)
 	c.Start()
-	defer c.Stop()
 
 	// Wait for terminated signal
 	kill := make(chan os.Signal, 1)
 	signal.Notify(kill, syscall.SIGINT, syscall.SIGTERM)
 	<-kill
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Stop scheduling runs, let the current one finish marking what it published and wait for it
+	jobs := c.Stop()
+	if err := jobProcessor.Shutdown(ctx); err != nil {
+		log.Println("Error stopping outbox processor:", err)
+	}
+	if err := shared.WaitDone(ctx, jobs.Done()); err != nil {
+		log.Println("Error waiting for outbox jobs:", err)
+	}
+
+	// The deferred close shuts the publishing channel and the connection down
+	return nil
 }
 
 func closeConnection(c io.Closer) {
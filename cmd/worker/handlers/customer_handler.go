@@ -1,32 +1,21 @@
 package handlers
 
 import (
-	"encoding/json"
+	"context"
 	"log"
 	"outbox/customer"
-
-	"gorm.io/datatypes"
+	"outbox/shared"
 )
 
 type CustomerHandler struct{}
 
-func (h *CustomerHandler) HandleMessage(eventName string, payload datatypes.JSON) error {
-	switch eventName {
-	case "CustomerCreated":
-		return h.handleCustomerCreated(payload)
+// Register subscribes the customer event handlers to the registry
+func (h *CustomerHandler) Register(r *shared.HandlerRegistry) {
+	shared.Register(r, "CustomerCreated", h.handleCustomerCreated, shared.Aggregate("customer"), shared.ReplaySafe())
 	// Add other customer event types as needed
-	default:
-		log.Printf("Unknown customer event: %s\n", eventName)
-		return nil
-	}
 }
 
-func (h *CustomerHandler) handleCustomerCreated(payload datatypes.JSON) error {
-	var customer customer.Customer
-	if err := json.Unmarshal(payload, &customer); err != nil {
-		return err
-	}
-
+func (h *CustomerHandler) handleCustomerCreated(ctx context.Context, customer customer.Customer) error {
 	// Do something with the customer data
 	log.Printf("Processing CustomerCreated event: Customer ID=%s, Name=%s, Email=%s\n",
 		customer.ID, customer.Name, customer.Email)
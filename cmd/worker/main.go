@@ -1,21 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
 	"outbox/cmd/worker/handlers"
-	"outbox/cmd/worker/inbox"
 	"outbox/database"
 	"outbox/queue"
 	"outbox/shared"
 	"syscall"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"github.com/robfig/cron/v3"
+	"github.com/streadway/amqp"
 	"gorm.io/datatypes"
 )
 
@@ -23,6 +25,7 @@ type OutboxEvent struct {
 	ID        string         `json:"id"`
 	EventName string         `json:"event_name"`
 	Payload   datatypes.JSON `json:"payload"`
+	ExpiresAt *time.Time     `json:"expires_at"`
 }
 
 func main() {
@@ -30,106 +33,158 @@ func main() {
 		log.Println("loading env file: ", err)
 	}
 
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run starts the worker and blocks until it is stopped. Errors are returned instead of calling
+// log.Fatal so the deferred closes still run.
+func run() error {
 	db, err := database.NewConnection()
 	if err != nil {
-		log.Fatal("error connecting to db: ", err)
+		return fmt.Errorf("error connecting to db: %w", err)
+	}
+
+	const consumerName = "worker"
+	if err := shared.MigrateInbox(db, consumerName); err != nil {
+		return fmt.Errorf("migrate error - %w", err)
 	}
 
-	if err := db.AutoMigrate(&shared.InboxMessage{}); err != nil {
-		log.Fatal("migrate error - ", err)
+	unknownEventPolicy, err := shared.ParseUnknownEventPolicy(os.Getenv("INBOX_UNKNOWN_EVENT_POLICY"))
+	if err != nil {
+		return err
 	}
 
+	registry := shared.NewHandlerRegistry(unknownEventPolicy)
 	customerHandler := &handlers.CustomerHandler{}
-	inboxProcessor := inbox.Processor{
-		DB:      db,
-		Handler: customerHandler,
+	customerHandler.Register(registry)
+
+	inboxProcessor := shared.InboxProcessor{
+		DB:           db,
+		Handler:      registry,
+		ConsumerName: consumerName,
+		Middlewares:  []shared.Middleware{shared.Logging()},
+	}
+	if err := inboxProcessor.ConfigureFromEnv(); err != nil {
+		return err
 	}
 
-	conn, err := queue.CreateConnection()
-	if err != nil {
-		log.Fatal(err)
+	inboxRetention := shared.InboxRetention{
+		DB:           db,
+		ConsumerName: inboxProcessor.ConsumerName,
+	}
+	if err := inboxRetention.ConfigureFromEnv(); err != nil {
+		return err
 	}
-	defer closeConnection(conn)
 
-	ch, err := queue.CreateChannel(conn)
-	if err != nil {
-		log.Fatal(err)
+	// Consume messages from RabbitMQ, acking them only once they are saved to the inbox
+	queueName := queue.ConsumerQueueName(inboxProcessor.ConsumerName)
+	consumer := queue.Consumer{
+		Queue:              queueName,
+		DeadLetterExchange: queue.DeadLetterExchangeName(queueName),
+		Offsets:            &shared.StreamOffsetStore{DB: db, ConsumerName: inboxProcessor.ConsumerName},
+	}
+	if err := consumer.ConfigureFromEnv(); err != nil {
+		return err
 	}
-	defer closeConnection(ch)
 
-	exchangeName := "outbox_events"
+	// How long to wait for in-flight work on SIGTERM
+	shutdownTimeout, err := shared.ShutdownTimeoutFromEnv()
+	if err != nil {
+		return err
+	}
 
-	queueName := "worker2_queue_" + uuid.NewString()[0:8]
-	q, err := ch.QueueDeclare(
-		queueName,
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
+	// Fail fast on a broken RabbitMQ config instead of retrying the connection forever
+	rabbitConfig, err := queue.LoadConfig()
 	if err != nil {
-		log.Fatalf("Failed to declare queue: %v", err)
+		return fmt.Errorf("invalid RabbitMQ config: %w", err)
 	}
 
-	err = ch.QueueBind(
-		q.Name,
-		"",
-		exchangeName,
-		false,
-		nil,
-	)
+	// On a topic exchange the worker queue is only bound to the events the registry handles
+	exchange, err := queue.OutboxExchangeFromEnv()
 	if err != nil {
-		log.Fatalf("Failed to bind queue: %v", err)
+		return err
+	}
+
+	// Connect to RabbitMQ and declare the outbox exchange, the worker queue with its dead-letter and
+	// delay queues. Reconnects whenever the connection is lost and restarts the consumer.
+	exchangeName := exchange.Name
+	connection := &queue.ConnectionManager{
+		Dial:          rabbitConfig.Dial,
+		Topology:      queue.WorkerTopology(consumer.WorkerQueue(exchange, registry.RoutingKeys())),
+		OnStateChange: queue.LogStateChange,
 	}
+	if err := connection.Start(); err != nil {
+		return err
+	}
+	defer closeConnection(connection)
 
-	log.Printf("Worker 2 created queue %s and bound to exchange %s", q.Name, exchangeName)
+	log.Printf("Declared queue %s and bound to exchange %s", queueName, exchangeName)
 
-	c := cron.New()
+	// Skip a tick while the previous run is still draining the inbox
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger)))
 	_, err = c.AddFunc("@every 10s", inboxProcessor.ProcessMessages)
 	if err != nil {
-		log.Fatal("register inbox processor error", err)
+		return fmt.Errorf("register inbox processor error: %w", err)
 	}
-	c.Start()
-	defer c.Stop()
-
-	messages, err := ch.Consume(
-		q.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
+	_, err = c.AddFunc("@every 1h", inboxRetention.Run)
 	if err != nil {
-		log.Fatal("Failed to register a consumer", err)
-	}
-
-	go func() {
-		for m := range messages {
-			var evt OutboxEvent
-			if err := json.Unmarshal(m.Body, &evt); err != nil {
-				log.Println("Handle message error: ", string(m.Body))
-				log.Println("ERR:", err)
-				m.Nack(false, true) // Không xóa message, requeue lại
-				continue
-			}
-
-			if err := inboxProcessor.SaveMessage(evt.EventName, evt.Payload); err != nil {
-				log.Printf("Failed to save message to inbox: %v\n", err)
-				m.Nack(false, true) // Không xóa message, requeue lại
-				continue
-			}
-
-			log.Printf("Worker 2 received [%s] - Payload: '%s' and saved to inbox", evt.EventName, evt.Payload)
-			m.Ack(false)
+		return fmt.Errorf("register inbox retention error: %w", err)
+	}
+	c.Start()
+
+	err = connection.Consume(&consumer, func(m amqp.Delivery) error {
+		// Compressed messages carry their content encoding
+		body, err := shared.Decompress(m.ContentEncoding, m.Body)
+		if err != nil {
+			return fmt.Errorf("%w: decompress message: %w", queue.ErrPermanent, err)
 		}
-	}()
+
+		var evt OutboxEvent
+		if err := json.Unmarshal(body, &evt); err != nil {
+			log.Println("Handle message error: ", string(body))
+			return fmt.Errorf("%w: decode message: %w", queue.ErrPermanent, err)
+		}
+
+		// Save message to inbox, deduplicated on the outbox ID the relay sets as MessageId
+		err = inboxProcessor.ReceiveMessageWithID(m.MessageId, evt.EventName, evt.Payload,
+			shared.WithPriority(m.Priority), shared.WithExpiry(evt.ExpiresAt))
+		if err != nil {
+			return fmt.Errorf("save message to inbox: %w", err)
+		}
+
+		log.Printf("Worker received [%s] - Payload: '%s' and saved to inbox", evt.EventName, evt.Payload)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register a consumer: %w", err)
+	}
+	log.Printf("Worker consuming from queue [%s] bound to exchange [%s]\n", queueName, exchangeName)
 
 	kill := make(chan os.Signal, 1)
 	signal.Notify(kill, syscall.SIGINT, syscall.SIGTERM)
 	<-kill
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Stop taking deliveries and wait until the ones received are saved to the inbox and acked
+	if err := connection.StopConsuming(ctx); err != nil {
+		log.Println("Error stopping consumers:", err)
+	}
+
+	// Stop scheduling runs and wait for in-flight handlers, cancelling them at the deadline
+	jobs := c.Stop()
+	if err := inboxProcessor.Shutdown(ctx); err != nil {
+		log.Println("Error stopping inbox processor:", err)
+	}
+	if err := shared.WaitDone(ctx, jobs.Done()); err != nil {
+		log.Println("Error waiting for inbox jobs:", err)
+	}
+
+	// The deferred close shuts the channels and the connection down
+	return nil
 }
 
 func closeConnection(c io.Closer) {
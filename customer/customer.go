@@ -2,6 +2,7 @@ package customer
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/datatypes"
@@ -18,8 +19,21 @@ type Customer struct {
 	UpdatedAt time.Time
 }
 
+// Validate checks the fields every customer event must carry
+func (c Customer) Validate() error {
+	if c.ID == "" {
+		return errors.New("customer id is required")
+	}
+	if c.Email == "" {
+		return errors.New("customer email is required")
+	}
+	return nil
+}
+
 type Handler struct {
 	DB *gorm.DB
+	// Compression selects the outbox payloads stored and published compressed
+	Compression shared.Compression
 }
 
 func (h *Handler) Add(c *fiber.Ctx) error {
@@ -38,10 +52,14 @@ func (h *Handler) Add(c *fiber.Ctx) error {
 		}
 
 		customerCreatedEvent := shared.OutBoxMessage{
-			ID:          uuid.NewString(),
-			EventName:   "CustomerCreated",
-			Payload:     datatypes.JSON(b),
-			IsProcessed: false,
+			ID:            uuid.NewString(),
+			AggregateType: "customer",
+			EventName:     "CustomerCreated",
+			Payload:       datatypes.JSON(b),
+			IsProcessed:   false,
+		}
+		if err := customerCreatedEvent.Compress(h.Compression); err != nil {
+			return err
 		}
 
 		if err := tx.FirstOrCreate(&customer).Error; err != nil {
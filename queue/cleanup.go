@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// FindOrphanedQueues returns the queues starting with prefix that have no consumers, such as the
+// per-instance queues workers declared before they shared a queue per consumer group
+func FindOrphanedQueues(client *ManagementClient, vhost, prefix string) ([]QueueInfo, error) {
+	queues, err := client.ListQueues(vhost)
+	if err != nil {
+		return nil, err
+	}
+
+	orphaned := make([]QueueInfo, 0)
+	for _, q := range queues {
+		if strings.HasPrefix(q.Name, prefix) && q.Consumers == 0 {
+			orphaned = append(orphaned, q)
+		}
+	}
+	return orphaned, nil
+}
+
+// DeleteQueues deletes the given queues and returns the number of messages dropped with them.
+// Deleting a queue that gained a consumer in the meantime fails and closes the channel.
+func DeleteQueues(ch *amqp.Channel, queues []QueueInfo) (int, error) {
+	dropped := 0
+	for _, q := range queues {
+		n, err := ch.QueueDelete(
+			q.Name, // name
+			true,   // if unused
+			false,  // if empty
+			false,  // no-wait
+		)
+		if err != nil {
+			return dropped, err
+		}
+		dropped += n
+	}
+	return dropped, nil
+}
@@ -0,0 +1,223 @@
+package queue
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Config describes how to connect to RabbitMQ
+type Config struct {
+	// URL is a full amqp:// or amqps:// URL. When set it replaces Host, Port, Username, Password and VHost.
+	URL string
+
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// VHost is the virtual host, "/" when empty
+	VHost string
+
+	// TLS connects with amqps. CACertFile verifies the server, CertFile and KeyFile authenticate the client.
+	TLS        bool
+	CACertFile string
+	CertFile   string
+	KeyFile    string
+
+	// Heartbeat is the heartbeat interval negotiated with the broker, 10s when zero
+	Heartbeat time.Duration
+	// ConnectionName is shown in the management UI, the executable name when empty
+	ConnectionName string
+}
+
+// LoadConfig reads the connection settings from the environment:
+// RABBITMQ_URL, or RABBITMQ_HOST, RABBITMQ_PORT, RABBITMQ_USER, RABBITMQ_PASS and RABBITMQ_VHOST,
+// plus RABBITMQ_TLS, RABBITMQ_CA_CERT, RABBITMQ_CLIENT_CERT, RABBITMQ_CLIENT_KEY,
+// RABBITMQ_HEARTBEAT and RABBITMQ_CONNECTION_NAME. The result is validated.
+func LoadConfig() (Config, error) {
+	cfg := Config{
+		URL:            os.Getenv("RABBITMQ_URL"),
+		Host:           os.Getenv("RABBITMQ_HOST"),
+		Username:       os.Getenv("RABBITMQ_USER"),
+		Password:       os.Getenv("RABBITMQ_PASS"),
+		VHost:          os.Getenv("RABBITMQ_VHOST"),
+		CACertFile:     os.Getenv("RABBITMQ_CA_CERT"),
+		CertFile:       os.Getenv("RABBITMQ_CLIENT_CERT"),
+		KeyFile:        os.Getenv("RABBITMQ_CLIENT_KEY"),
+		ConnectionName: os.Getenv("RABBITMQ_CONNECTION_NAME"),
+	}
+
+	if v := os.Getenv("RABBITMQ_PORT"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid RABBITMQ_PORT %q: must be a number", v)
+		}
+		cfg.Port = port
+	}
+
+	if v := os.Getenv("RABBITMQ_TLS"); v != "" {
+		useTLS, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid RABBITMQ_TLS %q: must be true or false", v)
+		}
+		cfg.TLS = useTLS
+	}
+
+	if v := os.Getenv("RABBITMQ_HEARTBEAT"); v != "" {
+		heartbeat, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid RABBITMQ_HEARTBEAT %q: %w", v, err)
+		}
+		cfg.Heartbeat = heartbeat
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate reports the first setting that makes the config unusable
+func (c Config) Validate() error {
+	if c.URL != "" {
+		uri, err := amqp.ParseURI(c.URL)
+		if err != nil {
+			return fmt.Errorf("invalid RABBITMQ_URL: %w", err)
+		}
+		if c.TLS && uri.Scheme != "amqps" {
+			return errors.New("RABBITMQ_TLS is enabled but RABBITMQ_URL does not use amqps://")
+		}
+	} else {
+		if c.Host == "" {
+			return errors.New("RABBITMQ_HOST is required when RABBITMQ_URL is not set")
+		}
+		if c.Username == "" {
+			return errors.New("RABBITMQ_USER is required when RABBITMQ_URL is not set")
+		}
+	}
+
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid RABBITMQ_PORT %d: must be between 1 and 65535", c.Port)
+	}
+
+	if c.Heartbeat < 0 {
+		return fmt.Errorf("invalid RABBITMQ_HEARTBEAT %s: must not be negative", c.Heartbeat)
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("RABBITMQ_CLIENT_CERT and RABBITMQ_CLIENT_KEY must be set together")
+	}
+
+	if !c.useTLS() && (c.CACertFile != "" || c.CertFile != "") {
+		return errors.New("TLS certificates are set but TLS is disabled, set RABBITMQ_TLS=true or use amqps://")
+	}
+
+	for name, file := range map[string]string{
+		"RABBITMQ_CA_CERT":     c.CACertFile,
+		"RABBITMQ_CLIENT_CERT": c.CertFile,
+		"RABBITMQ_CLIENT_KEY":  c.KeyFile,
+	} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// AMQPURL returns the connection URL with the credentials and vhost escaped,
+// so passwords containing characters such as "@" or "/" work
+func (c Config) AMQPURL() string {
+	if c.URL != "" {
+		return c.URL
+	}
+
+	scheme, port := "amqp", 5672
+	if c.TLS {
+		scheme, port = "amqps", 5671
+	}
+	if c.Port != 0 {
+		port = c.Port
+	}
+
+	vhost := c.VHost
+	if vhost == "" {
+		vhost = "/"
+	}
+
+	u := url.URL{
+		Scheme:  scheme,
+		User:    url.UserPassword(c.Username, c.Password),
+		Host:    net.JoinHostPort(c.Host, strconv.Itoa(port)),
+		RawPath: "/" + url.PathEscape(vhost),
+		Path:    "/" + vhost,
+	}
+	return u.String()
+}
+
+// Dial opens a connection with the config
+func (c Config) Dial() (*amqp.Connection, error) {
+	amqpConfig := amqp.Config{
+		Heartbeat:  c.Heartbeat,
+		Properties: amqp.Table{"connection_name": c.connectionName()},
+	}
+	if amqpConfig.Heartbeat == 0 {
+		amqpConfig.Heartbeat = 10 * time.Second
+	}
+
+	if c.useTLS() {
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		amqpConfig.TLSClientConfig = tlsConfig
+	}
+
+	return amqp.DialConfig(c.AMQPURL(), amqpConfig)
+}
+
+func (c Config) useTLS() bool {
+	return c.TLS || strings.HasPrefix(c.URL, "amqps://")
+}
+
+func (c Config) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.CACertFile != "" {
+		pem, err := os.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("read RABBITMQ_CA_CERT: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("RABBITMQ_CA_CERT %s contains no PEM certificates", c.CACertFile)
+		}
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load RABBITMQ_CLIENT_CERT and RABBITMQ_CLIENT_KEY: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func (c Config) connectionName() string {
+	if c.ConnectionName != "" {
+		return c.ConnectionName
+	}
+	return filepath.Base(os.Args[0])
+}
@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const _defaultConfirmTimeout = 10 * time.Second
+
+var (
+	// ErrUnroutable is returned when the broker returns a mandatory message because no queue is bound
+	// to receive it, e.g. when the delay queue of a retry delay was not declared
+	ErrUnroutable = errors.New("message is unroutable")
+	// ErrPublishNacked is returned when the broker fails to take responsibility for a message
+	ErrPublishNacked = errors.New("broker rejected the message")
+	// ErrConfirmTimeout is returned when the broker does not confirm a message in time
+	ErrConfirmTimeout = errors.New("timed out waiting for the publish confirmation")
+)
+
+// ConfirmedPublisher publishes mandatory messages on a channel in confirm mode, used by the relay for
+// outbox messages and by consumers to republish failed deliveries. Publishes are serialized so each one
+// waits for its own confirmation. The broker sends basic.return before the basic.ack of the same message,
+// so a return buffered by the time the confirmation arrives belongs to that message.
+type ConfirmedPublisher struct {
+	// Timeout is how long Publish waits for the confirmation, 10s when unset
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	lastTag  uint64
+}
+
+// NewConfirmedPublisher puts ch in confirm mode and publishes on it
+func NewConfirmedPublisher(ch *amqp.Channel) (*ConfirmedPublisher, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("enable publisher confirms: %w", err)
+	}
+
+	return &ConfirmedPublisher{
+		ch:       ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, 1)),
+	}, nil
+}
+
+// Channel returns the channel the publisher publishes on
+func (p *ConfirmedPublisher) Channel() *amqp.Channel {
+	return p.ch
+}
+
+// Publish publishes a mandatory message and waits until the broker confirms it
+func (p *ConfirmedPublisher) Publish(exchange, routingKey string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dropStaleReturns()
+
+	if err := p.ch.Publish(exchange, routingKey, true, false, msg); err != nil {
+		return err
+	}
+	p.lastTag++
+	tag := p.lastTag
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = _defaultConfirmTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case confirm, ok := <-p.confirms:
+			if !ok {
+				return errors.New("channel closed before the publish was confirmed")
+			}
+			// Confirmation of an earlier publish that timed out
+			if confirm.DeliveryTag < tag {
+				continue
+			}
+			if !confirm.Ack {
+				return ErrPublishNacked
+			}
+
+			select {
+			case ret, ok := <-p.returns:
+				if ok {
+					return fmt.Errorf("%w: %d %s", ErrUnroutable, ret.ReplyCode, ret.ReplyText)
+				}
+			default:
+			}
+			return nil
+		case <-timer.C:
+			return ErrConfirmTimeout
+		}
+	}
+}
+
+// dropStaleReturns discards returns of earlier publishes that timed out
+func (p *ConfirmedPublisher) dropStaleReturns() {
+	for {
+		select {
+		case _, ok := <-p.returns:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
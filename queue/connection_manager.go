@@ -0,0 +1,465 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	_defaultMinReconnectDelay = time.Second
+	_defaultMaxReconnectDelay = 30 * time.Second
+)
+
+var (
+	// ErrNotConnected is returned by Channel while the manager is reconnecting
+	ErrNotConnected = errors.New("not connected to RabbitMQ")
+	// ErrManagerClosed is returned once the manager is closed
+	ErrManagerClosed = errors.New("connection manager closed")
+)
+
+// ConnectionState is the state of a ConnectionManager
+type ConnectionState int
+
+const (
+	// StateConnecting means a connection attempt is in progress
+	StateConnecting ConnectionState = iota
+	// StateConnected means the connection is up and consumers are running
+	StateConnected
+	// StateDisconnected means the connection was lost or an attempt failed, a reconnect follows
+	StateDisconnected
+	// StateClosed means the manager was closed and will not reconnect
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnectionEvent reports a state change of a ConnectionManager
+type ConnectionEvent struct {
+	State ConnectionState
+	// Attempt is the number of the connection attempt, starting at 1 after every lost connection
+	Attempt int
+	// Err is why the connection was lost or the attempt failed
+	Err error
+}
+
+type managedConsumer struct {
+	consumer *Consumer
+	handler  DeliveryHandler
+	// channels are the channels the consumer runs on by consumer tag
+	channels map[string]*amqp.Channel
+	// restartDelays are the next backoff delays of channels restarted by consumer tag
+	restartDelays map[string]time.Duration
+}
+
+// ConnectionManager keeps a RabbitMQ connection alive. When the connection closes it reconnects with
+// backoff, declares Topology again, restarts the registered consumers and replaces the publishing channel.
+type ConnectionManager struct {
+	// Dial opens a connection, CreateConnection when nil
+	Dial func() (*amqp.Connection, error)
+	// Topology is declared after every (re)connect
+	Topology Topology
+	// MinReconnectDelay and MaxReconnectDelay bound the exponential backoff between attempts
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+	// OnStateChange is called on every state change
+	OnStateChange func(event ConnectionEvent)
+
+	mu        sync.Mutex
+	conn      *amqp.Connection
+	channel   *amqp.Channel
+	consumers []*managedConsumer
+	stopping  bool
+	closed    bool
+	done      chan struct{}
+}
+
+// Start connects, retrying with backoff until it succeeds or the manager is closed,
+// and keeps reconnecting in the background afterwards
+func (m *ConnectionManager) Start() error {
+	m.mu.Lock()
+	if m.done == nil {
+		m.done = make(chan struct{})
+	}
+	m.mu.Unlock()
+
+	closeErrs, err := m.reconnect()
+	if err != nil {
+		return err
+	}
+
+	go m.watch(closeErrs)
+	return nil
+}
+
+// Consume registers a consumer. Its Channel is set and it is started on every (re)connect.
+// Consumers registered after Start are started right away.
+func (m *ConnectionManager) Consume(consumer *Consumer, handler DeliveryHandler) error {
+	mc := &managedConsumer{
+		consumer:      consumer,
+		handler:       handler,
+		channels:      make(map[string]*amqp.Channel),
+		restartDelays: make(map[string]time.Duration),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed || m.stopping {
+		return ErrManagerClosed
+	}
+
+	m.consumers = append(m.consumers, mc)
+	if m.conn == nil || m.conn.IsClosed() {
+		return nil
+	}
+	return m.startConsumer(m.conn, mc)
+}
+
+// Channel returns the channel for publishing, reopening it if it was closed by a channel error
+func (m *ConnectionManager) Channel() (*amqp.Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrManagerClosed
+	}
+	if m.conn == nil || m.conn.IsClosed() {
+		return nil, ErrNotConnected
+	}
+
+	if m.channel == nil {
+		ch, err := m.conn.Channel()
+		if err != nil {
+			return nil, err
+		}
+		m.channel = ch
+		m.forgetChannelOnClose(ch)
+	}
+	return m.channel, nil
+}
+
+// StopConsuming cancels every consumer so the broker stops sending deliveries, then waits until the
+// handlers of the deliveries already received returned and acked them, or ctx is done.
+// Consumers are not restarted afterwards, while the publishing channel keeps working until Close.
+func (m *ConnectionManager) StopConsuming(ctx context.Context) error {
+	m.mu.Lock()
+	m.stopping = true
+	consumers := append([]*managedConsumer(nil), m.consumers...)
+	for _, mc := range consumers {
+		mc.consumer.stop()
+		for tag, ch := range mc.channels {
+			if err := ch.Cancel(tag, false); err != nil {
+				log.Printf("Error cancelling consumer %s of %s: %v\n", tag, mc.consumer.Queue, err)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, mc := range consumers {
+		if err := mc.consumer.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops reconnecting and closes the connection
+func (m *ConnectionManager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	if m.done != nil {
+		close(m.done)
+	}
+	conn := m.conn
+	m.conn = nil
+	m.channel = nil
+	m.mu.Unlock()
+
+	m.emit(ConnectionEvent{State: StateClosed})
+
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// watch reconnects whenever the current connection closes
+func (m *ConnectionManager) watch(closeErrs chan *amqp.Error) {
+	for {
+		select {
+		case <-m.done:
+			return
+		case amqpErr, ok := <-closeErrs:
+			var err error
+			if ok && amqpErr != nil {
+				err = amqpErr
+			}
+			if m.isClosed() {
+				return
+			}
+			m.emit(ConnectionEvent{State: StateDisconnected, Err: err})
+
+			closeErrs, err = m.reconnect()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// reconnect connects with backoff until it succeeds or the manager is closed
+func (m *ConnectionManager) reconnect() (chan *amqp.Error, error) {
+	delay := m.minReconnectDelay()
+	for attempt := 1; ; attempt++ {
+		if m.isClosed() {
+			return nil, ErrManagerClosed
+		}
+
+		m.emit(ConnectionEvent{State: StateConnecting, Attempt: attempt})
+		closeErrs, err := m.connect()
+		if err == nil {
+			m.emit(ConnectionEvent{State: StateConnected, Attempt: attempt})
+			return closeErrs, nil
+		}
+		m.emit(ConnectionEvent{State: StateDisconnected, Attempt: attempt, Err: err})
+
+		select {
+		case <-m.done:
+			return nil, ErrManagerClosed
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > m.maxReconnectDelay() {
+			delay = m.maxReconnectDelay()
+		}
+	}
+}
+
+// connect dials, declares the topology and starts the consumers
+func (m *ConnectionManager) connect() (chan *amqp.Error, error) {
+	dial := m.Dial
+	if dial == nil {
+		dial = CreateConnection
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := m.Topology.Apply(ch); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		conn.Close()
+		return nil, ErrManagerClosed
+	}
+
+	// Consumers stay stopped after StopConsuming
+	for _, mc := range m.consumers {
+		if m.stopping {
+			break
+		}
+		if err := m.startConsumer(conn, mc); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// The topology channel becomes the publishing channel
+	m.conn = conn
+	m.channel = ch
+	m.forgetChannelOnClose(ch)
+
+	return conn.NotifyClose(make(chan *amqp.Error, 1)), nil
+}
+
+// startConsumer opens the channels of a consumer and starts it on each of them.
+// Must be called with m.mu held.
+func (m *ConnectionManager) startConsumer(conn *amqp.Connection, mc *managedConsumer) error {
+	channels := mc.consumer.channels()
+
+	// Consumers need a known tag to be cancelled by StopConsuming
+	name := mc.consumer.Name
+	if name == "" {
+		name = defaultConsumerTag(mc.consumer.Queue)
+	}
+
+	for i := 0; i < channels; i++ {
+		tag := name
+		if channels > 1 {
+			tag = fmt.Sprintf("%s-%d", name, i)
+		}
+
+		ch, err := m.startConsumerChannel(conn, mc, tag)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			mc.consumer.Channel = ch
+		}
+	}
+
+	return nil
+}
+
+// startConsumerChannel opens a channel for a consumer and starts it. If only the channel closes, after a
+// channel error or when the consumer closed it, the consumer is restarted on a new channel of the same connection.
+// Must be called with m.mu held.
+func (m *ConnectionManager) startConsumerChannel(conn *amqp.Connection, mc *managedConsumer, tag string) (*amqp.Channel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mc.consumer.StartOn(ch, tag, mc.handler); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	mc.channels[tag] = ch
+
+	channelErrs := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go m.restartConsumerChannel(conn, mc, tag, channelErrs, time.Now())
+
+	return ch, nil
+}
+
+// restartConsumerChannel waits until a consumer channel closes and restarts the consumer with backoff,
+// retrying until it runs again. The backoff grows while the channel keeps closing soon after it started,
+// e.g. a stream stopping at the same failing delivery, and starts over once it stayed open.
+func (m *ConnectionManager) restartConsumerChannel(conn *amqp.Connection, mc *managedConsumer, tag string, channelErrs chan *amqp.Error, started time.Time) {
+	if amqpErr := <-channelErrs; amqpErr != nil {
+		log.Printf("Consumer channel of %s closed: %v\n", mc.consumer.Queue, amqpErr)
+	} else {
+		log.Printf("Consumer channel of %s closed\n", mc.consumer.Queue)
+	}
+
+	m.mu.Lock()
+	delay := mc.restartDelays[tag]
+	if delay == 0 || time.Since(started) > m.maxReconnectDelay() {
+		delay = m.minReconnectDelay()
+	}
+	m.mu.Unlock()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > m.maxReconnectDelay() {
+			delay = m.maxReconnectDelay()
+		}
+
+		m.mu.Lock()
+		// A lost connection is handled by watch, which restarts every consumer
+		if m.closed || m.stopping || m.conn != conn || conn.IsClosed() {
+			m.mu.Unlock()
+			return
+		}
+		mc.restartDelays[tag] = delay
+		_, err := m.startConsumerChannel(conn, mc, tag)
+		m.mu.Unlock()
+
+		if err == nil {
+			return
+		}
+		log.Printf("Error restarting consumer of %s, retrying in %s: %v\n", mc.consumer.Queue, delay, err)
+	}
+}
+
+// forgetChannelOnClose drops the publishing channel once it closes so Channel opens a new one.
+// Must be called with m.mu held.
+func (m *ConnectionManager) forgetChannelOnClose(ch *amqp.Channel) {
+	closeErrs := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		<-closeErrs
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.channel == ch {
+			m.channel = nil
+		}
+	}()
+}
+
+// defaultConsumerTag is a consumer tag unique to the queue and process
+func defaultConsumerTag(queueName string) string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s.%s.%d", queueName, hostname, os.Getpid())
+}
+
+func (m *ConnectionManager) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+func (m *ConnectionManager) emit(event ConnectionEvent) {
+	if m.OnStateChange != nil {
+		m.OnStateChange(event)
+	}
+}
+
+func (m *ConnectionManager) minReconnectDelay() time.Duration {
+	if m.MinReconnectDelay <= 0 {
+		return _defaultMinReconnectDelay
+	}
+	return m.MinReconnectDelay
+}
+
+func (m *ConnectionManager) maxReconnectDelay() time.Duration {
+	if m.MaxReconnectDelay <= 0 {
+		return _defaultMaxReconnectDelay
+	}
+	return m.MaxReconnectDelay
+}
+
+// LogStateChange logs connection state changes, meant as ConnectionManager.OnStateChange
+func LogStateChange(event ConnectionEvent) {
+	switch {
+	case event.Err != nil:
+		log.Printf("RabbitMQ connection %s (attempt %d): %v\n", event.State, event.Attempt, event.Err)
+	case event.Attempt > 0:
+		log.Printf("RabbitMQ connection %s (attempt %d)\n", event.State, event.Attempt)
+	default:
+		log.Printf("RabbitMQ connection %s\n", event.State)
+	}
+}
@@ -0,0 +1,545 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	_defaultMaxRequeues   = 3
+	_defaultPrefetchCount = 10
+
+	// HeaderRetryCount counts how many times the consumer republished a failed delivery
+	HeaderRetryCount = "x-retry-count"
+	// HeaderFailureReason holds the last error of a failed delivery
+	HeaderFailureReason = "x-failure-reason"
+	// HeaderOriginalQueue is the queue a dead-lettered delivery was consumed from
+	HeaderOriginalQueue = "x-original-queue"
+	// HeaderFailedAt is when a delivery was dead-lettered
+	HeaderFailedAt = "x-failed-at"
+	// HeaderExpiresAt is when a message expires in Unix milliseconds, so a republished delivery gets the
+	// time left as its expiration instead of the original one
+	HeaderExpiresAt = "x-expires-at"
+)
+
+// ErrPermanent marks a handler error retrying cannot fix, such as a body that cannot be decoded.
+// Deliveries failing with it are dead-lettered straight away.
+var ErrPermanent = errors.New("permanent delivery failure")
+
+// DeliveryHandler handles a delivery. The delivery is acknowledged when it returns nil.
+type DeliveryHandler func(d amqp.Delivery) error
+
+// Consumer consumes a queue with manual acknowledgement: a delivery is acked only after its handler
+// succeeds, so nothing is lost when the handler fails or the process crashes.
+// Failed deliveries are retried up to MaxRequeues times and then dead-lettered with the failure reason.
+type Consumer struct {
+	Channel *amqp.Channel
+	Queue   string
+	// Name is the consumer tag, generated by the broker when empty
+	Name string
+	// MaxRequeues is how many times a failed delivery is retried before it is dead-lettered
+	MaxRequeues int
+	// DeadLetterExchange receives deliveries that failed too often, see DeadLetterTopology.
+	// Without it they are rejected, which only dead-letters them if the queue has a DLX argument.
+	DeadLetterExchange string
+	// RetryDelays are the backoff delays of the delay queues declared with RetryTopology.
+	// The n-th retry waits for the n-th delay, the last one is reused for further retries.
+	// Without delays failed deliveries are retried straight away from the back of the queue.
+	RetryDelays []time.Duration
+	// PrefetchCount is how many unacknowledged deliveries the broker pushes to each channel, 10 when unset.
+	// Keeping it low stops one replica from taking the whole backlog into memory.
+	PrefetchCount int
+	// Concurrency is the number of goroutines handling the deliveries of each channel, 1 when unset
+	Concurrency int
+	// Channels is the number of channels ConnectionManager opens for the consumer, 1 when unset
+	Channels int
+	// MaxPriority is the x-max-priority of the consumed queue, see WorkerQueue
+	MaxPriority uint8
+	// QueueType is classic (the default), quorum or stream, see WorkerQueue
+	QueueType string
+	// DeliveryLimit is the x-delivery-limit of a quorum queue: deliveries redelivered more often, such as
+	// poison messages crashing the worker before it acks, are dead-lettered by the broker
+	DeliveryLimit int
+	// Deduplication declares the classic worker queue with x-message-deduplication, see WorkerQueue
+	Deduplication bool
+	// StreamOffset is where a stream consumer without a saved offset starts, see ParseStreamOffset
+	StreamOffset string
+	// Offsets saves the offset of every handled stream delivery so the consumer resumes after it.
+	// Without it a stream consumer always starts at StreamOffset.
+	Offsets OffsetStore
+	// Republish publishes retried and dead-lettered deliveries and returns once the broker confirmed them.
+	// When nil they are published on the channel the delivery arrived on, which StartOn puts in confirm mode.
+	Republish func(exchange, routingKey string, msg amqp.Publishing) error
+
+	handlers   sync.WaitGroup
+	mu         sync.Mutex
+	publishers map[*amqp.Channel]*ConfirmedPublisher
+	stopOnce   sync.Once
+	stopped    chan struct{}
+}
+
+// ConfigureFromEnv applies CONSUMER_MAX_REQUEUES, CONSUMER_RETRY_DELAYS, CONSUMER_PREFETCH,
+// CONSUMER_CONCURRENCY, CONSUMER_CHANNELS, CONSUMER_MAX_PRIORITY, CONSUMER_QUEUE_TYPE,
+// CONSUMER_DELIVERY_LIMIT, CONSUMER_DEDUPLICATION and CONSUMER_STREAM_OFFSET
+func (c *Consumer) ConfigureFromEnv() error {
+	if v := os.Getenv("CONSUMER_MAX_REQUEUES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid CONSUMER_MAX_REQUEUES %q", v)
+		}
+		c.MaxRequeues = n
+	}
+
+	if v := os.Getenv("CONSUMER_RETRY_DELAYS"); v != "" {
+		delays, err := ParseRetryDelays(v)
+		if err != nil {
+			return fmt.Errorf("invalid CONSUMER_RETRY_DELAYS %q: %w", v, err)
+		}
+		c.RetryDelays = delays
+	}
+
+	settings := []struct {
+		name  string
+		value *int
+	}{
+		{"CONSUMER_PREFETCH", &c.PrefetchCount},
+		{"CONSUMER_CONCURRENCY", &c.Concurrency},
+		{"CONSUMER_CHANNELS", &c.Channels},
+	}
+	for _, setting := range settings {
+		if v := os.Getenv(setting.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid %s %q", setting.name, v)
+			}
+			*setting.value = n
+		}
+	}
+
+	if v := os.Getenv("CONSUMER_MAX_PRIORITY"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid CONSUMER_MAX_PRIORITY %q", v)
+		}
+		c.MaxPriority = uint8(n)
+	}
+
+	if v := os.Getenv("CONSUMER_QUEUE_TYPE"); v != "" {
+		c.QueueType = v
+	}
+
+	if v := os.Getenv("CONSUMER_DELIVERY_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid CONSUMER_DELIVERY_LIMIT %q", v)
+		}
+		c.DeliveryLimit = n
+	}
+
+	if v := os.Getenv("CONSUMER_DEDUPLICATION"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid CONSUMER_DEDUPLICATION %q", v)
+		}
+		c.Deduplication = enabled
+	}
+
+	if v := os.Getenv("CONSUMER_STREAM_OFFSET"); v != "" {
+		if _, err := ParseStreamOffset(v); err != nil {
+			return fmt.Errorf("invalid CONSUMER_STREAM_OFFSET: %w", err)
+		}
+		c.StreamOffset = v
+	}
+
+	return c.validateQueueType()
+}
+
+// validateQueueType rejects settings the queue type does not support
+func (c *Consumer) validateQueueType() error {
+	switch c.QueueType {
+	case "", QueueTypeClassic:
+	case QueueTypeQuorum, QueueTypeStream:
+		if c.MaxPriority > 0 {
+			return errors.New("CONSUMER_MAX_PRIORITY is only supported by classic queues")
+		}
+		if c.Deduplication {
+			return errors.New("CONSUMER_DEDUPLICATION is only supported by classic queues")
+		}
+	default:
+		return fmt.Errorf("invalid CONSUMER_QUEUE_TYPE %q, use classic, quorum or stream", c.QueueType)
+	}
+
+	if c.DeliveryLimit > 0 && c.QueueType != QueueTypeQuorum {
+		return errors.New("CONSUMER_DELIVERY_LIMIT is only supported by quorum queues")
+	}
+	if c.StreamOffset != "" && c.QueueType != QueueTypeStream {
+		return errors.New("CONSUMER_STREAM_OFFSET is only supported by streams")
+	}
+
+	return nil
+}
+
+// WorkerQueue describes the queue the consumer reads, for WorkerTopology
+func (c *Consumer) WorkerQueue(exchange Exchange, routingKeys []string) WorkerQueue {
+	return WorkerQueue{
+		Name:          c.Queue,
+		Exchange:      exchange,
+		RoutingKeys:   routingKeys,
+		RetryDelays:   c.RetryDelays,
+		MaxPriority:   c.MaxPriority,
+		Type:          c.QueueType,
+		DeliveryLimit: c.DeliveryLimit,
+		Deduplication: c.Deduplication,
+	}
+}
+
+// Start registers the consumer on Channel and handles deliveries in the background until the channel closes
+func (c *Consumer) Start(handler DeliveryHandler) error {
+	return c.StartOn(c.Channel, c.Name, handler)
+}
+
+// StartOn registers the consumer on ch with the given consumer tag, sets its prefetch count, puts ch in
+// confirm mode for republishing and handles deliveries with Concurrency goroutines until the channel closes
+func (c *Consumer) StartOn(ch *amqp.Channel, tag string, handler DeliveryHandler) error {
+	prefetchCount := c.PrefetchCount
+	if prefetchCount < 1 {
+		prefetchCount = _defaultPrefetchCount
+	}
+
+	if err := ch.Qos(prefetchCount, 0, false); err != nil {
+		return err
+	}
+
+	if c.Republish == nil {
+		if err := c.addPublisher(ch); err != nil {
+			return err
+		}
+	}
+
+	var args amqp.Table
+	if c.isStream() {
+		offset, err := c.streamOffset()
+		if err != nil {
+			return err
+		}
+		args = amqp.Table{HeaderStreamOffset: offset}
+	}
+
+	deliveries, err := ch.Consume(
+		c.Queue,
+		tag,   // consumer
+		false, // auto-ack
+		false, // exclusive
+		false, // no-local
+		false, // no-wait
+		args,  // args
+	)
+	if err != nil {
+		return err
+	}
+
+	c.HandleDeliveries(deliveries, handler)
+	return nil
+}
+
+// HandleDeliveries handles deliveries with Concurrency goroutines in the background until the channel
+// is closed. Wait waits for them.
+func (c *Consumer) HandleDeliveries(deliveries <-chan amqp.Delivery, handler DeliveryHandler) {
+	for i := 0; i < c.concurrency(); i++ {
+		c.handlers.Add(1)
+		go func() {
+			defer c.handlers.Done()
+			for d := range deliveries {
+				c.HandleDelivery(d, handler)
+			}
+		}()
+	}
+}
+
+// Wait blocks until the deliveries of every channel the consumer was started on stopped and their
+// handlers returned, or ctx is done. Deliveries stop once the consumer is cancelled or its channel closes.
+func (c *Consumer) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for in-flight deliveries of %s: %w", c.Queue, ctx.Err())
+	}
+}
+
+// HandleDelivery runs handler for a delivery, then acks it on success. Failed deliveries are retried
+// with RetryLater until they used up MaxRequeues and are dead-lettered afterwards, or straight away when
+// the error is ErrPermanent. Stream deliveries are handled by handleStream.
+func (c *Consumer) HandleDelivery(d amqp.Delivery, handler DeliveryHandler) {
+	if c.isStream() {
+		c.handleStream(d, handler)
+		return
+	}
+
+	err := handler(d)
+	if err == nil {
+		if err := d.Ack(false); err != nil {
+			log.Println("Error acking delivery:", err)
+		}
+		return
+	}
+
+	if errors.Is(err, ErrPermanent) {
+		log.Printf("Failed to handle delivery from %s, dead-lettering it: %v\n", c.Queue, err)
+		c.deadLetter(d, err)
+		return
+	}
+
+	attempts := DeliveryAttempts(d) + 1
+	if attempts > c.maxRequeues() {
+		log.Printf("Failed to handle delivery from %s, dead-lettering after %d attempts: %v\n", c.Queue, attempts, err)
+		c.deadLetter(d, err)
+		return
+	}
+
+	log.Printf("Failed to handle delivery from %s, retrying (attempt %d): %v\n", c.Queue, attempts, err)
+	c.RetryLater(d, err)
+}
+
+// RetryLater republishes a delivery with an incremented retry count, through the delay queue of the
+// next backoff delay when RetryDelays are set or to the back of the queue otherwise, and acks it once
+// the broker confirmed the republish. Unlike a requeueing nack this lets the count and failure reason
+// travel with the message.
+func (c *Consumer) RetryLater(d amqp.Delivery, cause error) {
+	retries := retryCount(d)
+	headers := copyHeaders(d.Headers)
+	headers[HeaderRetryCount] = int32(retries + 1)
+	headers[HeaderFailureReason] = cause.Error()
+
+	routingKey := c.Queue
+	if len(c.RetryDelays) > 0 {
+		delay := c.RetryDelays[len(c.RetryDelays)-1]
+		if retries < len(c.RetryDelays) {
+			delay = c.RetryDelays[retries]
+		}
+		routingKey = DelayQueueName(c.Queue, delay)
+	}
+
+	if err := c.republish(d, "", routingKey, republishing(d, headers)); err != nil {
+		log.Println("Error republishing delivery, requeueing it:", err)
+		requeue(d)
+		return
+	}
+
+	if err := d.Ack(false); err != nil {
+		log.Println("Error acking delivery:", err)
+	}
+}
+
+// deadLetter publishes a delivery to the dead-letter exchange with the failure reason attached and
+// acks it once the broker confirmed the publish
+func (c *Consumer) deadLetter(d amqp.Delivery, cause error) {
+	if c.DeadLetterExchange == "" {
+		if err := d.Nack(false, false); err != nil {
+			log.Println("Error rejecting delivery:", err)
+		}
+		return
+	}
+
+	if err := c.publishDeadLetter(d, cause); err != nil {
+		log.Println("Error dead-lettering delivery, requeueing it:", err)
+		requeue(d)
+		return
+	}
+
+	if err := d.Ack(false); err != nil {
+		log.Println("Error acking delivery:", err)
+	}
+}
+
+// publishDeadLetter republishes a delivery to DeadLetterExchange and returns once the broker confirmed it
+func (c *Consumer) publishDeadLetter(d amqp.Delivery, cause error) error {
+	headers := copyHeaders(d.Headers)
+	headers[HeaderFailureReason] = cause.Error()
+	headers[HeaderOriginalQueue] = c.Queue
+	headers[HeaderFailedAt] = time.Now().UTC().Format(time.RFC3339)
+
+	// Dead letters are kept until someone looks at them
+	msg := republishing(d, headers)
+	msg.Expiration = ""
+	return c.republish(d, c.DeadLetterExchange, c.Queue, msg)
+}
+
+// requeue returns a delivery to its queue when republishing it failed, so it is never lost
+func requeue(d amqp.Delivery) {
+	if err := d.Nack(false, true); err != nil {
+		log.Println("Error nacking delivery:", err)
+	}
+}
+
+// republish publishes a failed delivery again with Republish, or on the channel it arrived on otherwise,
+// and returns once the broker confirmed it
+func (c *Consumer) republish(d amqp.Delivery, exchange, routingKey string, msg amqp.Publishing) error {
+	if c.Republish != nil {
+		return c.Republish(exchange, routingKey, msg)
+	}
+
+	ch := deliveryChannel(d, c.Channel)
+	c.mu.Lock()
+	publisher := c.publishers[ch]
+	c.mu.Unlock()
+	if publisher == nil {
+		return errors.New("channel of the delivery is not in confirm mode")
+	}
+	return publisher.Publish(exchange, routingKey, msg)
+}
+
+// addPublisher puts a consumer channel in confirm mode for republishing, until the channel closes
+func (c *Consumer) addPublisher(ch *amqp.Channel) error {
+	publisher, err := NewConfirmedPublisher(ch)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.publishers == nil {
+		c.publishers = make(map[*amqp.Channel]*ConfirmedPublisher)
+	}
+	c.publishers[ch] = publisher
+	c.mu.Unlock()
+
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		<-closed
+		c.mu.Lock()
+		delete(c.publishers, ch)
+		c.mu.Unlock()
+	}()
+	return nil
+}
+
+// deliveryChannel returns the channel a delivery arrived on, so it is republished and acked on the
+// same channel even after Channel was replaced by a reconnect
+func deliveryChannel(d amqp.Delivery, fallback *amqp.Channel) *amqp.Channel {
+	if ch, ok := d.Acknowledger.(*amqp.Channel); ok {
+		return ch
+	}
+	return fallback
+}
+
+func (c *Consumer) isStream() bool {
+	return c.QueueType == QueueTypeStream
+}
+
+// concurrency is the number of goroutines per channel. Stream offsets are saved in delivery order,
+// so streams are handled by a single goroutine.
+func (c *Consumer) concurrency() int {
+	if c.Concurrency < 1 || c.isStream() {
+		return 1
+	}
+	return c.Concurrency
+}
+
+// channels is the number of channels to consume on. Every channel of a stream consumer would receive
+// the whole stream, so streams use a single channel.
+func (c *Consumer) channels() int {
+	if c.Channels < 1 || c.isStream() {
+		return 1
+	}
+	return c.Channels
+}
+
+func (c *Consumer) maxRequeues() int {
+	if c.MaxRequeues == 0 {
+		return _defaultMaxRequeues
+	}
+	return c.MaxRequeues
+}
+
+// DeliveryAttempts returns how many times a delivery failed before: the retry count set by Consumer
+// plus the x-death counts the broker adds when the message is rejected and the x-delivery-count of
+// quorum queues redelivering unacked messages. Expirations in delay queues are not counted again
+// since they are already part of the retry count.
+func DeliveryAttempts(d amqp.Delivery) int {
+	attempts := retryCount(d)
+	if count, ok := d.Headers["x-delivery-count"].(int64); ok {
+		attempts += int(count)
+	}
+
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	for _, death := range deaths {
+		table, ok := death.(amqp.Table)
+		if !ok {
+			continue
+		}
+		if reason, _ := table["reason"].(string); reason == "expired" {
+			continue
+		}
+		if count, ok := table["count"].(int64); ok {
+			attempts += int(count)
+		}
+	}
+
+	return attempts
+}
+
+func retryCount(d amqp.Delivery) int {
+	switch v := d.Headers[HeaderRetryCount].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
+	}
+}
+
+func copyHeaders(headers amqp.Table) amqp.Table {
+	copied := make(amqp.Table, len(headers)+3)
+	for k, v := range headers {
+		copied[k] = v
+	}
+	return copied
+}
+
+// republishing copies a delivery into a new persistent publishing with the given headers.
+// The expiration is the time left until HeaderExpiresAt, a copied one would restart with every retry.
+func republishing(d amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	msg := amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+	if expiresAt, ok := headers[HeaderExpiresAt].(int64); ok {
+		msg.Expiration = Expiration(time.UnixMilli(expiresAt), time.Now())
+	}
+	return msg
+}
+
+// Expiration is the AMQP expiration of a message expiring at expiresAt, 0 once it passed
+func Expiration(expiresAt, now time.Time) string {
+	ttl := expiresAt.Sub(now).Milliseconds()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return strconv.FormatInt(ttl, 10)
+}
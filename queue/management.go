@@ -0,0 +1,125 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ManagementClient talks to the RabbitMQ management HTTP API, which can list broker objects
+// that AMQP itself cannot
+type ManagementClient struct {
+	BaseURL    string
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+}
+
+// QueueInfo is a queue as reported by the management API
+type QueueInfo struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Exclusive  bool                   `json:"exclusive"`
+	Arguments  map[string]interface{} `json:"arguments"`
+	Consumers  int                    `json:"consumers"`
+	Messages   int                    `json:"messages"`
+}
+
+// ExchangeInfo is an exchange as reported by the management API
+type ExchangeInfo struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost"`
+	Type       string                 `json:"type"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Internal   bool                   `json:"internal"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// BindingInfo is a binding as reported by the management API
+type BindingInfo struct {
+	Source          string                 `json:"source"`
+	Vhost           string                 `json:"vhost"`
+	Destination     string                 `json:"destination"`
+	DestinationType string                 `json:"destination_type"`
+	RoutingKey      string                 `json:"routing_key"`
+	Arguments       map[string]interface{} `json:"arguments"`
+}
+
+// NewManagementClientFromEnv uses RABBITMQ_MANAGEMENT_URL, defaulting to port 15672 of RABBITMQ_HOST,
+// with the RABBITMQ_USER and RABBITMQ_PASS credentials. The host and credentials of RABBITMQ_URL
+// take precedence when it is set.
+func NewManagementClientFromEnv() *ManagementClient {
+	host := os.Getenv("RABBITMQ_HOST")
+	username := os.Getenv("RABBITMQ_USER")
+	password := os.Getenv("RABBITMQ_PASS")
+	if uri, err := amqp.ParseURI(os.Getenv("RABBITMQ_URL")); err == nil {
+		host, username, password = uri.Host, uri.Username, uri.Password
+	}
+
+	baseURL := os.Getenv("RABBITMQ_MANAGEMENT_URL")
+	if baseURL == "" {
+		baseURL = fmt.Sprintf("http://%s:15672", host)
+	}
+
+	return &ManagementClient{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Username:   username,
+		Password:   password,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ListQueues returns the queues of a vhost
+func (c *ManagementClient) ListQueues(vhost string) ([]QueueInfo, error) {
+	var queues []QueueInfo
+	err := c.get("/api/queues/"+url.PathEscape(vhost), &queues)
+	return queues, err
+}
+
+// ListExchanges returns the exchanges of a vhost
+func (c *ManagementClient) ListExchanges(vhost string) ([]ExchangeInfo, error) {
+	var exchanges []ExchangeInfo
+	err := c.get("/api/exchanges/"+url.PathEscape(vhost), &exchanges)
+	return exchanges, err
+}
+
+// ListBindings returns the bindings of a vhost
+func (c *ManagementClient) ListBindings(vhost string) ([]BindingInfo, error) {
+	var bindings []BindingInfo
+	err := c.get("/api/bindings/"+url.PathEscape(vhost), &bindings)
+	return bindings, err
+}
+
+func (c *ManagementClient) get(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, c.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.Username, c.Password)
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("management API %s returned %s", path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
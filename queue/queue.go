@@ -1,20 +1,30 @@
 package queue
 
 import (
-	"fmt"
 	"os"
 
 	"github.com/streadway/amqp"
 )
 
+// CreateConnection connects with the config loaded from the environment, see LoadConfig
 func CreateConnection() (*amqp.Connection, error) {
-	ampqURL := fmt.Sprintf(
-		"amqp://%s:%s@%s:%s",
-		os.Getenv("RABBITMQ_USER"), os.Getenv("RABBITMQ_PASS"),
-		os.Getenv("RABBITMQ_HOST"), os.Getenv("RABBITMQ_PORT"))
-	return amqp.Dial(ampqURL)
+	cfg, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Dial()
 }
 
 func CreateChannel(conn *amqp.Connection) (*amqp.Channel, error) {
 	return conn.Channel()
 }
+
+// ConsumerQueueName returns the queue shared by all replicas of a consumer group, so they compete for
+// messages while every consumer group still receives every event through the fanout exchange.
+// WORKER_QUEUE overrides the default "<consumer>_queue".
+func ConsumerQueueName(consumerName string) string {
+	if name := os.Getenv("WORKER_QUEUE"); name != "" {
+		return name
+	}
+	return consumerName + "_queue"
+}
@@ -0,0 +1,53 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DelayQueueName is the retry queue of a work queue holding messages for the given delay
+func DelayQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%dms", queueName, delay.Milliseconds())
+}
+
+// RetryTopology declares a delay queue per delay for a work queue. Messages published to a
+// delay queue wait for its TTL and are then dead-lettered back to the work queue, so retries
+// neither block the work queue nor need the database to be polled.
+func RetryTopology(queueName string, delays []time.Duration) Topology {
+	var t Topology
+	for _, delay := range delays {
+		t.Queues = append(t.Queues, Queue{
+			Name:    DelayQueueName(queueName, delay),
+			Durable: true,
+			Arguments: amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queueName,
+			},
+		})
+	}
+	return t
+}
+
+// ParseRetryDelays parses a comma separated list of durations such as "5s,30s,2m"
+func ParseRetryDelays(s string) ([]time.Duration, error) {
+	var delays []time.Duration
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		delay, err := time.ParseDuration(item)
+		if err != nil {
+			return nil, err
+		}
+		if delay <= 0 {
+			return nil, fmt.Errorf("retry delay %s must be positive", item)
+		}
+		delays = append(delays, delay)
+	}
+	return delays, nil
+}
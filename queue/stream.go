@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// HeaderStreamOffset is the offset RabbitMQ sets on every delivery from a stream
+const HeaderStreamOffset = "x-stream-offset"
+
+// _defaultStreamRetryDelay is the first in-place retry delay of a stream delivery without RetryDelays,
+// doubled for every further attempt
+const _defaultStreamRetryDelay = time.Second
+
+// OffsetStore keeps the offset of the last stream delivery a consumer handled, so it resumes after it
+type OffsetStore interface {
+	// LoadOffset returns the saved offset of a stream, ok is false when nothing was saved yet
+	LoadOffset(stream string) (offset int64, ok bool, err error)
+	// SaveOffset saves the offset of a handled delivery
+	SaveOffset(stream string, offset int64) error
+}
+
+// ParseStreamOffset parses where a stream consumer without a saved offset starts: first to replay the
+// whole stream, last, next (the default) for new messages only, a numeric offset or an RFC3339 timestamp
+func ParseStreamOffset(s string) (interface{}, error) {
+	switch s {
+	case "":
+		return "next", nil
+	case "first", "last", "next":
+		return s, nil
+	}
+
+	if offset, err := strconv.ParseInt(s, 10, 64); err == nil && offset >= 0 {
+		return offset, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("stream offset must be first, last, next, a number or an RFC3339 timestamp, got %q", s)
+}
+
+// streamOffset returns the offset a stream consumer starts from: after the saved offset if any,
+// StreamOffset otherwise
+func (c *Consumer) streamOffset() (interface{}, error) {
+	if c.Offsets != nil {
+		offset, ok, err := c.Offsets.LoadOffset(c.Queue)
+		if err != nil {
+			return nil, fmt.Errorf("load offset of stream %s: %w", c.Queue, err)
+		}
+		if ok {
+			return offset + 1, nil
+		}
+	}
+
+	return ParseStreamOffset(c.StreamOffset)
+}
+
+// saveStreamOffset records that a stream delivery was handled or dead-lettered
+func (c *Consumer) saveStreamOffset(d amqp.Delivery) error {
+	if c.Offsets == nil {
+		return nil
+	}
+
+	offset, ok := d.Headers[HeaderStreamOffset].(int64)
+	if !ok {
+		return fmt.Errorf("delivery from stream %s has no %s header", c.Queue, HeaderStreamOffset)
+	}
+
+	return c.Offsets.SaveOffset(c.Queue, offset)
+}
+
+// handleStream handles a stream delivery. Streams keep every message and have no requeue, so a failed
+// delivery is retried in place with the RetryDelays backoff, up to MaxRequeues times. When it still fails
+// the consumer stops without saving the offset and resumes at the failing delivery once ConnectionManager
+// restarted it. Only ErrPermanent failures are dead-lettered and skipped.
+func (c *Consumer) handleStream(d amqp.Delivery, handler DeliveryHandler) {
+	err := handler(d)
+	for attempt := 1; err != nil && !errors.Is(err, ErrPermanent); attempt++ {
+		if attempt > c.maxRequeues() {
+			log.Printf("Failed to handle delivery from stream %s %d times, stopping the consumer: %v\n", c.Queue, attempt, err)
+			c.stopStream(d)
+			return
+		}
+
+		delay := c.streamRetryDelay(attempt)
+		log.Printf("Failed to handle delivery from stream %s, retrying in %s (attempt %d): %v\n", c.Queue, delay, attempt, err)
+		if !c.sleep(delay) {
+			// Stopping, the delivery is handled again once the consumer resumes after the saved offset
+			return
+		}
+		err = handler(d)
+	}
+
+	if err != nil {
+		log.Printf("Failed to handle delivery from stream %s, dead-lettering it: %v\n", c.Queue, err)
+		if c.DeadLetterExchange == "" {
+			log.Printf("Stream %s has no dead-letter exchange, skipping the delivery\n", c.Queue)
+		} else if err := c.publishDeadLetter(d, err); err != nil {
+			log.Printf("Error dead-lettering delivery from stream %s, stopping the consumer: %v\n", c.Queue, err)
+			c.stopStream(d)
+			return
+		}
+	}
+
+	if err := d.Ack(false); err != nil {
+		log.Println("Error acking delivery:", err)
+	}
+	if err := c.saveStreamOffset(d); err != nil {
+		log.Println("Error saving stream offset:", err)
+	}
+}
+
+// streamRetryDelay is the delay before the given in-place retry of a stream delivery
+func (c *Consumer) streamRetryDelay(attempt int) time.Duration {
+	if len(c.RetryDelays) == 0 {
+		return _defaultStreamRetryDelay << (attempt - 1)
+	}
+	if attempt > len(c.RetryDelays) {
+		return c.RetryDelays[len(c.RetryDelays)-1]
+	}
+	return c.RetryDelays[attempt-1]
+}
+
+// stopStream closes the channel of a stream delivery without acking it, which stops the consumer.
+// ConnectionManager restarts it on a new channel with backoff, from the offset after the last saved one.
+func (c *Consumer) stopStream(d amqp.Delivery) {
+	ch := deliveryChannel(d, c.Channel)
+	if ch == nil {
+		return
+	}
+	if err := ch.Close(); err != nil {
+		log.Printf("Error closing the channel of stream %s: %v\n", c.Queue, err)
+	}
+}
+
+// sleep waits for d and reports false when the consumer is stopped first
+func (c *Consumer) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-c.stopChan():
+		return false
+	}
+}
+
+// stop interrupts in-place retries, called by ConnectionManager.StopConsuming
+func (c *Consumer) stop() {
+	ch := c.stopChan()
+	c.stopOnce.Do(func() { close(ch) })
+}
+
+func (c *Consumer) stopChan() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped == nil {
+		c.stopped = make(chan struct{})
+	}
+	return c.stopped
+}
@@ -0,0 +1,261 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// OutboxExchange is the fanout exchange the relay publishes outbox messages to
+	OutboxExchange = "outbox_events"
+	// OutboxTopicExchange is the topic exchange the relay publishes outbox messages to, routed by RoutingKey.
+	// An existing exchange cannot change its type, so the topic exchange has its own name.
+	OutboxTopicExchange = "outbox_events.topic"
+)
+
+// Exchange declares an exchange
+type Exchange struct {
+	Name       string
+	Type       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	Arguments  amqp.Table
+}
+
+// Queue declares a queue
+type Queue struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Arguments  amqp.Table
+}
+
+// Binding binds a queue to an exchange
+type Binding struct {
+	Queue      string
+	Exchange   string
+	RoutingKey string
+	Arguments  amqp.Table
+}
+
+// Topology lists the exchanges, queues and bindings a service needs
+type Topology struct {
+	Exchanges []Exchange
+	Queues    []Queue
+	Bindings  []Binding
+}
+
+// Merge returns a topology with the objects of t followed by those of others
+func (t Topology) Merge(others ...Topology) Topology {
+	merged := Topology{
+		Exchanges: append([]Exchange(nil), t.Exchanges...),
+		Queues:    append([]Queue(nil), t.Queues...),
+		Bindings:  append([]Binding(nil), t.Bindings...),
+	}
+	for _, other := range others {
+		merged.Exchanges = append(merged.Exchanges, other.Exchanges...)
+		merged.Queues = append(merged.Queues, other.Queues...)
+		merged.Bindings = append(merged.Bindings, other.Bindings...)
+	}
+	return merged
+}
+
+// Apply declares the topology. Declaring is idempotent, so every service applies its topology at startup.
+// It fails if an object already exists with different properties.
+func (t Topology) Apply(ch *amqp.Channel) error {
+	for _, e := range t.Exchanges {
+		err := ch.ExchangeDeclare(
+			e.Name,       // name
+			e.Type,       // type
+			e.Durable,    // durable
+			e.AutoDelete, // auto-deleted
+			e.Internal,   // internal
+			false,        // no-wait
+			e.Arguments,  // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("declare exchange %s: %w", e.Name, err)
+		}
+	}
+
+	for _, q := range t.Queues {
+		_, err := ch.QueueDeclare(
+			q.Name,       // name
+			q.Durable,    // durable
+			q.AutoDelete, // delete when unused
+			q.Exclusive,  // exclusive
+			false,        // no-wait
+			q.Arguments,  // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("declare queue %s: %w", q.Name, err)
+		}
+	}
+
+	for _, b := range t.Bindings {
+		err := ch.QueueBind(
+			b.Queue,      // queue name
+			b.RoutingKey, // routing key
+			b.Exchange,   // exchange
+			false,        // no-wait
+			b.Arguments,  // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("bind queue %s to exchange %s: %w", b.Queue, b.Exchange, err)
+		}
+	}
+
+	return nil
+}
+
+// OutboxExchangeOfType returns the outbox exchange of the given type, fanout when empty
+func OutboxExchangeOfType(exchangeType string) (Exchange, error) {
+	switch exchangeType {
+	case "", amqp.ExchangeFanout:
+		return Exchange{Name: OutboxExchange, Type: amqp.ExchangeFanout, Durable: true}, nil
+	case amqp.ExchangeTopic:
+		return Exchange{Name: OutboxTopicExchange, Type: amqp.ExchangeTopic, Durable: true}, nil
+	default:
+		return Exchange{}, fmt.Errorf("unsupported outbox exchange type %q, use fanout or topic", exchangeType)
+	}
+}
+
+// OutboxExchangeFromEnv returns the outbox exchange of the type in OUTBOX_EXCHANGE_TYPE
+func OutboxExchangeFromEnv() (Exchange, error) {
+	return OutboxExchangeOfType(os.Getenv("OUTBOX_EXCHANGE_TYPE"))
+}
+
+// OutboxTopology declares the exchange outbox messages are published to
+func OutboxTopology(exchange Exchange) Topology {
+	return Topology{
+		Exchanges: []Exchange{exchange},
+	}
+}
+
+// RelayTopology is the topology of the relay. It declares no queue of its own: every published message
+// must be routed to a worker queue, otherwise the broker returns it and it stays pending.
+func RelayTopology(exchange Exchange) Topology {
+	return OutboxTopology(exchange)
+}
+
+// Queue types of worker queues
+const (
+	QueueTypeClassic = "classic"
+	QueueTypeQuorum  = "quorum"
+	QueueTypeStream  = "stream"
+)
+
+// WorkerQueue describes the work queue of a worker and how it receives outbox messages
+type WorkerQueue struct {
+	Name     string
+	Exchange Exchange
+	// RoutingKeys bind the queue to a topic exchange, a fanout exchange delivers every event
+	RoutingKeys []string
+	// RetryDelays declare a delay queue each, see RetryTopology
+	RetryDelays []time.Duration
+	// MaxPriority declares a priority queue delivering higher priority messages first, 0 for a plain queue.
+	// RabbitMQ cannot change it on an existing queue, so the queue has to be recreated to enable it.
+	MaxPriority uint8
+	// Type is classic (the default), quorum or stream. Like MaxPriority it only applies to new queues.
+	Type string
+	// DeliveryLimit is the x-delivery-limit of a quorum queue, 0 for the broker default
+	DeliveryLimit int
+	// Deduplication declares a classic queue with x-message-deduplication, so the RabbitMQ message
+	// deduplication plugin drops messages whose x-deduplication-header it already queued.
+	// Like MaxPriority it only applies to new queues.
+	Deduplication bool
+}
+
+// WorkerTopology is the topology of a worker: the outbox exchange, the work queue bound to it,
+// its dead-letter exchange and queue and a delay queue per retry delay
+// A stream has no dead-letter arguments or delay queues, Consumer publishes failed deliveries to the
+// dead-letter exchange itself.
+func WorkerTopology(q WorkerQueue) Topology {
+	workerQueue := Topology{
+		Queues: []Queue{
+			{Name: q.Name, Durable: true, Arguments: workerQueueArguments(q)},
+		},
+		Bindings: outboxBindings(q.Name, q.Exchange, q.RoutingKeys),
+	}
+
+	if q.Type == QueueTypeStream {
+		return OutboxTopology(q.Exchange).Merge(workerQueue, DeadLetterTopology(q.Name))
+	}
+
+	return OutboxTopology(q.Exchange).Merge(
+		workerQueue,
+		DeadLetterTopology(q.Name),
+		RetryTopology(q.Name, q.RetryDelays),
+	)
+}
+
+func workerQueueArguments(q WorkerQueue) amqp.Table {
+	if q.Type == QueueTypeStream {
+		return amqp.Table{"x-queue-type": QueueTypeStream}
+	}
+
+	arguments := amqp.Table{
+		"x-dead-letter-exchange":    DeadLetterExchangeName(q.Name),
+		"x-dead-letter-routing-key": q.Name,
+	}
+	if q.MaxPriority > 0 {
+		arguments["x-max-priority"] = int32(q.MaxPriority)
+	}
+	if q.Deduplication {
+		arguments["x-message-deduplication"] = true
+	}
+	if q.Type == QueueTypeQuorum {
+		arguments["x-queue-type"] = QueueTypeQuorum
+		if q.DeliveryLimit > 0 {
+			arguments["x-delivery-limit"] = int32(q.DeliveryLimit)
+		}
+	}
+	return arguments
+}
+
+func outboxBindings(queueName string, exchange Exchange, routingKeys []string) []Binding {
+	if exchange.Type != amqp.ExchangeTopic {
+		return []Binding{{Queue: queueName, Exchange: exchange.Name}}
+	}
+
+	bindings := make([]Binding, 0, len(routingKeys))
+	for _, routingKey := range routingKeys {
+		bindings = append(bindings, Binding{Queue: queueName, Exchange: exchange.Name, RoutingKey: routingKey})
+	}
+	return bindings
+}
+
+// DeadLetterExchangeName is the dead-letter exchange of a work queue
+func DeadLetterExchangeName(queueName string) string {
+	return queueName + ".dlx"
+}
+
+// DeadLetterQueueName is the queue holding the dead-lettered messages of a work queue
+func DeadLetterQueueName(queueName string) string {
+	return queueName + ".dlq"
+}
+
+// DeadLetterTopology declares the dead-letter exchange and queue of a work queue.
+// Dead-lettered messages keep the work queue name as routing key.
+func DeadLetterTopology(queueName string) Topology {
+	return Topology{
+		Exchanges: []Exchange{
+			{Name: DeadLetterExchangeName(queueName), Type: amqp.ExchangeDirect, Durable: true},
+		},
+		Queues: []Queue{
+			{Name: DeadLetterQueueName(queueName), Durable: true},
+		},
+		Bindings: []Binding{
+			{
+				Queue:      DeadLetterQueueName(queueName),
+				Exchange:   DeadLetterExchangeName(queueName),
+				RoutingKey: queueName,
+			},
+		},
+	}
+}
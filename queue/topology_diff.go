@@ -0,0 +1,121 @@
+package queue
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/streadway/amqp"
+)
+
+// Diff compares the topology with the live broker through the management API and describes every
+// object that is missing or declared with different properties. An empty result means they match.
+func (t Topology) Diff(client *ManagementClient, vhost string) ([]string, error) {
+	exchanges, err := client.ListExchanges(vhost)
+	if err != nil {
+		return nil, err
+	}
+
+	queues, err := client.ListQueues(vhost)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings, err := client.ListBindings(vhost)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+
+	liveExchanges := make(map[string]ExchangeInfo, len(exchanges))
+	for _, e := range exchanges {
+		liveExchanges[e.Name] = e
+	}
+	for _, e := range t.Exchanges {
+		live, ok := liveExchanges[e.Name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("exchange %s is missing", e.Name))
+			continue
+		}
+		if live.Type != e.Type {
+			diffs = append(diffs, fmt.Sprintf("exchange %s has type %s, want %s", e.Name, live.Type, e.Type))
+		}
+		if live.Durable != e.Durable || live.AutoDelete != e.AutoDelete || live.Internal != e.Internal {
+			diffs = append(diffs, fmt.Sprintf("exchange %s has durable=%t auto_delete=%t internal=%t, want durable=%t auto_delete=%t internal=%t",
+				e.Name, live.Durable, live.AutoDelete, live.Internal, e.Durable, e.AutoDelete, e.Internal))
+		}
+		if !argumentsEqual(e.Arguments, live.Arguments) {
+			diffs = append(diffs, fmt.Sprintf("exchange %s has arguments %v, want %v", e.Name, live.Arguments, e.Arguments))
+		}
+	}
+
+	liveQueues := make(map[string]QueueInfo, len(queues))
+	for _, q := range queues {
+		liveQueues[q.Name] = q
+	}
+	for _, q := range t.Queues {
+		live, ok := liveQueues[q.Name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("queue %s is missing", q.Name))
+			continue
+		}
+		if live.Durable != q.Durable || live.AutoDelete != q.AutoDelete || live.Exclusive != q.Exclusive {
+			diffs = append(diffs, fmt.Sprintf("queue %s has durable=%t auto_delete=%t exclusive=%t, want durable=%t auto_delete=%t exclusive=%t",
+				q.Name, live.Durable, live.AutoDelete, live.Exclusive, q.Durable, q.AutoDelete, q.Exclusive))
+		}
+		if !argumentsEqual(q.Arguments, live.Arguments) {
+			diffs = append(diffs, fmt.Sprintf("queue %s has arguments %v, want %v", q.Name, live.Arguments, q.Arguments))
+		}
+	}
+
+	type bindingKey struct{ queue, exchange, routingKey string }
+	liveBindings := make(map[bindingKey]bool, len(bindings))
+	for _, b := range bindings {
+		if b.DestinationType == "queue" {
+			liveBindings[bindingKey{b.Destination, b.Source, b.RoutingKey}] = true
+		}
+	}
+	for _, b := range t.Bindings {
+		if !liveBindings[bindingKey{b.Queue, b.Exchange, b.RoutingKey}] {
+			diffs = append(diffs, fmt.Sprintf("binding of queue %s to exchange %s with routing key %q is missing", b.Queue, b.Exchange, b.RoutingKey))
+		}
+	}
+
+	return diffs, nil
+}
+
+// argumentsEqual compares declared arguments with the JSON decoded ones of the management API,
+// where every number is a float64
+func argumentsEqual(declared amqp.Table, live map[string]interface{}) bool {
+	if len(declared) != len(live) {
+		return false
+	}
+	for k, v := range declared {
+		liveValue, ok := live[k]
+		if !ok || !reflect.DeepEqual(normalizeArgument(v), normalizeArgument(liveValue)) {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeArgument(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int8:
+		return float64(n)
+	case int16:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint8:
+		return float64(n)
+	case float32:
+		return float64(n)
+	default:
+		return v
+	}
+}
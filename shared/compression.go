@@ -0,0 +1,155 @@
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings of compressed outbox payloads, sent as the AMQP content-encoding
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// Compression chooses which outbox payloads are compressed and how
+type Compression struct {
+	// Encoding compresses payloads of at least Threshold bytes, nothing is compressed by size when empty
+	Encoding string
+	// Threshold is the payload size in bytes from which Encoding applies
+	Threshold int
+	// Events sets the encoding of specific events whatever their size, "identity" to never compress them
+	Events map[string]string
+}
+
+// CompressionFromEnv reads OUTBOX_COMPRESSION, OUTBOX_COMPRESSION_THRESHOLD and OUTBOX_COMPRESSION_EVENTS
+func CompressionFromEnv() (Compression, error) {
+	c := Compression{Encoding: os.Getenv("OUTBOX_COMPRESSION")}
+	if err := validateEncoding(c.Encoding); err != nil {
+		return c, fmt.Errorf("invalid OUTBOX_COMPRESSION: %w", err)
+	}
+
+	if v := os.Getenv("OUTBOX_COMPRESSION_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return c, fmt.Errorf("invalid OUTBOX_COMPRESSION_THRESHOLD %q", v)
+		}
+		c.Threshold = n
+	}
+
+	// OUTBOX_COMPRESSION_EVENTS looks like "ReportGenerated=zstd,CustomerCreated=identity"
+	if v := os.Getenv("OUTBOX_COMPRESSION_EVENTS"); v != "" {
+		c.Events = make(map[string]string)
+		for _, entry := range strings.Split(v, ",") {
+			eventName, encoding, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok {
+				return c, fmt.Errorf("invalid OUTBOX_COMPRESSION_EVENTS entry %q", entry)
+			}
+			if err := validateEncoding(encoding); err != nil {
+				return c, fmt.Errorf("invalid OUTBOX_COMPRESSION_EVENTS entry %q: %w", entry, err)
+			}
+			c.Events[eventName] = encoding
+		}
+	}
+
+	return c, nil
+}
+
+// EncodingFor returns the encoding of a payload of the given event and size, empty for none
+func (c Compression) EncodingFor(eventName string, size int) string {
+	if encoding, ok := c.Events[eventName]; ok {
+		if encoding == "identity" {
+			return ""
+		}
+		return encoding
+	}
+
+	if c.Encoding != "" && size >= c.Threshold {
+		return c.Encoding
+	}
+	return ""
+}
+
+// Compress compresses data with a content encoding, empty or identity returns data as is
+func Compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case "", "identity":
+		return data, nil
+	case EncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case EncodingZstd:
+		encoder, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// Decompress reverses Compress
+func Decompress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case "", "identity":
+		return data, nil
+	case EncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case EncodingZstd:
+		_, decoder, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+func validateEncoding(encoding string) error {
+	switch encoding {
+	case "", "identity", EncodingGzip, EncodingZstd:
+		return nil
+	default:
+		return fmt.Errorf("unsupported content encoding %q, use gzip or zstd", encoding)
+	}
+}
+
+// zstdCodec returns the shared zstd encoder and decoder, both safe for concurrent EncodeAll and DecodeAll
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
@@ -8,17 +8,141 @@ import (
 	"time"
 
 	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// Inbox message statuses
+const (
+	// InboxStatusPending messages are waiting for their next attempt
+	InboxStatusPending = "pending"
+	// InboxStatusProcessed messages were handled successfully
+	InboxStatusProcessed = "processed"
+	// InboxStatusParked messages failed permanently or ran out of attempts and are no longer retried
+	InboxStatusParked = "parked"
+	// InboxStatusExpired messages passed their expiry before they were handled and are skipped
+	InboxStatusExpired = "expired"
 )
 
 type InboxMessage struct {
 	ID              string         `gorm:"primaryKey" json:"id"`
+	Consumer        string         `gorm:"size:64;index" json:"consumer"`
+	MessageID       string         `gorm:"size:64;index" json:"message_id"`
 	EventName       string         `gorm:"event_name" json:"event_name"`
 	Payload         datatypes.JSON `gorm:"payload" json:"payload"`
 	IsProcessed     bool           `gorm:"is_processed" json:"is_processed"`
+	Status          string         `gorm:"size:16;index;default:pending" json:"status"`
 	ProcessingCount int            `gorm:"processing_count" json:"processing_count"`
+	OrderingKey     string         `gorm:"size:128;index" json:"ordering_key"`
+	Priority        uint8          `gorm:"default:0" json:"priority"`
+	ExpiresAt       *time.Time     `json:"expires_at"`
+	ReceivedAt      time.Time      `gorm:"autoCreateTime;index" json:"received_at"`
+	LockedBy        string         `gorm:"size:128" json:"locked_by"`
+	LockedUntil     *time.Time     `gorm:"index" json:"locked_until"`
 	FirstAttemptAt  *time.Time     `gorm:"first_attempt_at" json:"first_attempt_at"`
 	LastAttemptAt   *time.Time     `gorm:"last_attempt_at" json:"last_attempt_at"`
+	NextAttemptAt   *time.Time     `gorm:"index" json:"next_attempt_at"`
+	LastError       string         `gorm:"type:text" json:"last_error"`
 	ProcessedAt     *time.Time     `gorm:"processed_at" json:"processed_at"`
+	ParkedAt        *time.Time     `json:"parked_at"`
+	ExpiredAt       *time.Time     `json:"expired_at"`
+}
+
+// MessageOption sets optional attributes of a received message before it is saved to the inbox
+type MessageOption func(msg *InboxMessage)
+
+// WithPriority claims the message ahead of lower priority ones, like a RabbitMQ priority queue
+func WithPriority(priority uint8) MessageOption {
+	return func(msg *InboxMessage) {
+		msg.Priority = priority
+	}
+}
+
+// WithExpiry skips the message when it was not handled before expiresAt
+func WithExpiry(expiresAt *time.Time) MessageOption {
+	return func(msg *InboxMessage) {
+		msg.ExpiresAt = expiresAt
+	}
+}
+
+// Expired reports whether the message passed its expiry at now
+func (m InboxMessage) Expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
+
+// MigrateInbox creates or updates the inbox tables, including the stream offsets of stream consumers.
+// Rows written before the status column existed are backfilled from is_processed and processing_count
+// when the column is added. Rows written before the consumer column existed are assigned to the consumer
+// among consumerNames whose name their content hash was generated with.
+func MigrateInbox(db *gorm.DB, consumerNames ...string) error {
+	hasStatus := db.Migrator().HasColumn(&InboxMessage{}, "status")
+
+	if err := db.AutoMigrate(&InboxMessage{}, &InboxDedupKey{}, &StreamOffset{}); err != nil {
+		return err
+	}
+
+	if !hasStatus {
+		if err := backfillStatus(db); err != nil {
+			return err
+		}
+	}
+
+	return backfillConsumer(db, consumerNames)
+}
+
+func backfillStatus(db *gorm.DB) error {
+	if err := db.Model(&InboxMessage{}).
+		Where("is_processed = ? AND status = ?", true, InboxStatusPending).
+		UpdateColumn("status", InboxStatusProcessed).Error; err != nil {
+		return err
+	}
+
+	// The previous processor gave up after 3 attempts without recording anything
+	return db.Model(&InboxMessage{}).
+		Where("is_processed = ? AND status = ? AND processing_count >= ?", false, InboxStatusPending, 3).
+		Updates(map[string]interface{}{
+			"status":     InboxStatusParked,
+			"last_error": "attempts exhausted before failures were recorded",
+		}).Error
+}
+
+// backfillConsumer recovers the consumer of rows without one from their ID, the content hash of
+// the event and the consumer name. Rows of consumers not listed keep an empty consumer until
+// that consumer migrates the inbox.
+func backfillConsumer(db *gorm.DB, consumerNames []string) error {
+	if len(consumerNames) == 0 {
+		return nil
+	}
+
+	var rows []InboxMessage
+	return db.Model(&InboxMessage{}).
+		Select("id", "event_name", "payload").
+		Where("consumer IS NULL OR consumer = ?", "").
+		FindInBatches(&rows, 100, func(tx *gorm.DB, batch int) error {
+			for _, row := range rows {
+				for _, consumerName := range consumerNames {
+					if GenerateContentHash(row.EventName, consumerName, row.Payload) != row.ID {
+						continue
+					}
+					if err := db.Model(&InboxMessage{}).
+						Where("id = ?", row.ID).
+						UpdateColumn("consumer", consumerName).Error; err != nil {
+						return err
+					}
+					break
+				}
+			}
+			return nil
+		}).Error
+}
+
+// FindParkedMessages returns parked messages of a consumer, most recently parked first
+func FindParkedMessages(db *gorm.DB, consumerName string, limit int) ([]InboxMessage, error) {
+	var messages []InboxMessage
+	err := db.Where("consumer = ? AND status = ?", consumerName, InboxStatusParked).
+		Order("parked_at DESC").
+		Limit(limit).
+		Find(&messages).Error
+	return messages, err
 }
 
 // GenerateContentHash creates a deterministic hash from event content
@@ -46,3 +170,11 @@ func GenerateContentHash(eventName, consumerName string, payload datatypes.JSON)
 	hasher.Write([]byte(eventName + consumerName + identifier))
 	return hex.EncodeToString(hasher.Sum(nil))
 }
+
+// GenerateMessageIDHash derives the inbox ID from the ID the publisher gave the message, the outbox ID
+// sent as AMQP MessageId, so every redelivery and republish of it maps to the same inbox row
+func GenerateMessageIDHash(messageID, consumerName string) string {
+	hasher := sha256.New()
+	hasher.Write([]byte("message-id:" + consumerName + ":" + messageID))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
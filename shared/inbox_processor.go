@@ -0,0 +1,631 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	_defaultBatchSize     = 10
+	_defaultLeaseDuration = time.Minute
+)
+
+// MessageHandler interface defines how to handle different types of messages
+type MessageHandler interface {
+	HandleMessage(ctx context.Context, eventName string, payload datatypes.JSON) error
+}
+
+// BatchHandler is optionally implemented by a MessageHandler that handles some events more
+// efficiently in bulk, e.g. search indexing or analytics sinks
+type BatchHandler interface {
+	// HandlesBatch reports whether messages of eventName are passed to HandleBatch
+	HandlesBatch(eventName string) bool
+	// HandleBatch handles messages of a single event. It returns one error per message,
+	// nil for messages that succeeded, or a nil slice when all of them succeeded.
+	HandleBatch(ctx context.Context, eventName string, messages []InboxMessage) []error
+}
+
+// OrderingKeyFunc extracts the key whose messages must be handled in the order they were received,
+// usually the aggregate ID. An empty key means the message can be handled in any order.
+type OrderingKeyFunc func(eventName string, payload datatypes.JSON) string
+
+// PayloadIDOrderingKey uses the top level "id" field of the payload as the ordering key
+func PayloadIDOrderingKey(eventName string, payload datatypes.JSON) string {
+	var v struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return ""
+	}
+	return v.ID
+}
+
+// InboxProcessor processes incoming messages from the inbox
+type InboxProcessor struct {
+	DB           *gorm.DB
+	Handler      MessageHandler
+	ConsumerName string
+	RetryPolicy  RetryPolicy
+
+	// Concurrency is the number of goroutines processing messages, 1 when unset
+	Concurrency int
+	// BatchSize is the number of messages a goroutine claims at once
+	BatchSize int
+	// LeaseDuration is how long claimed messages stay locked before another worker may take them over
+	LeaseDuration time.Duration
+	// OrderingKey enables per-key ordering: a message is only claimed once every earlier
+	// pending message with the same key is done
+	OrderingKey OrderingKeyFunc
+	// Middlewares wrap Handler, the first one being the outermost. Panics are always recovered.
+	Middlewares []Middleware
+	// HandlerTimeout is the deadline of a handler call, no deadline when zero
+	HandlerTimeout time.Duration
+	// EventTimeouts overrides HandlerTimeout for specific events
+	EventTimeouts map[string]time.Duration
+	// ProcessOnReceive handles messages right after ReceiveMessage saves them instead of
+	// waiting for the next ProcessMessages run, which stays as a safety net for failures and crashes
+	ProcessOnReceive bool
+
+	ctxOnce sync.Once
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mu       sync.Mutex
+	stopping bool
+	inflight sync.WaitGroup
+}
+
+// ConfigureFromEnv applies the INBOX_* environment settings to the processor
+func (p *InboxProcessor) ConfigureFromEnv() error {
+	retryPolicy, err := RetryPolicyFromEnv()
+	if err != nil {
+		return err
+	}
+	p.RetryPolicy = retryPolicy
+
+	if v := os.Getenv("INBOX_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid INBOX_CONCURRENCY %q", v)
+		}
+		p.Concurrency = n
+	}
+
+	if v := os.Getenv("INBOX_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid INBOX_BATCH_SIZE %q", v)
+		}
+		p.BatchSize = n
+	}
+
+	if v := os.Getenv("INBOX_PRESERVE_ORDERING"); v != "" {
+		preserve, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid INBOX_PRESERVE_ORDERING %q", v)
+		}
+		if preserve {
+			p.OrderingKey = PayloadIDOrderingKey
+		}
+	}
+
+	if v := os.Getenv("INBOX_PROCESS_ON_RECEIVE"); v != "" {
+		processOnReceive, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid INBOX_PROCESS_ON_RECEIVE %q", v)
+		}
+		p.ProcessOnReceive = processOnReceive
+	}
+
+	if v := os.Getenv("INBOX_HANDLER_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid INBOX_HANDLER_TIMEOUT %q: %w", v, err)
+		}
+		p.HandlerTimeout = d
+	}
+
+	// INBOX_EVENT_TIMEOUTS looks like "CustomerCreated=5s,OrderPlaced=1m"
+	if v := os.Getenv("INBOX_EVENT_TIMEOUTS"); v != "" {
+		p.EventTimeouts = make(map[string]time.Duration)
+		for _, entry := range strings.Split(v, ",") {
+			eventName, timeout, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok {
+				return fmt.Errorf("invalid INBOX_EVENT_TIMEOUTS entry %q", entry)
+			}
+			d, err := time.ParseDuration(timeout)
+			if err != nil {
+				return fmt.Errorf("invalid INBOX_EVENT_TIMEOUTS entry %q: %w", entry, err)
+			}
+			p.EventTimeouts[eventName] = d
+		}
+	}
+
+	return nil
+}
+
+// Shutdown stops claiming new messages and waits for the batches being handled. When ctx is done first,
+// the context of in-flight handlers is cancelled so their messages are released for the next run.
+func (p *InboxProcessor) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.stopping = true
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(done)
+	}()
+
+	err := WaitDone(ctx, done)
+	p.baseContext()
+	p.cancel()
+	if err != nil {
+		return fmt.Errorf("waiting for in-flight inbox messages: %w", err)
+	}
+	return nil
+}
+
+// beginBatch registers a batch about to be claimed or handled, it returns false once Shutdown started
+func (p *InboxProcessor) beginBatch() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopping {
+		return false
+	}
+	p.inflight.Add(1)
+	return true
+}
+
+// baseContext is the parent context of every handler call, cancelled by Shutdown
+func (p *InboxProcessor) baseContext() context.Context {
+	p.ctxOnce.Do(func() {
+		p.ctx, p.cancel = context.WithCancel(context.Background())
+	})
+	return p.ctx
+}
+
+// ReceiveMessage saves a message to the inbox and, with ProcessOnReceive, processes it straight away.
+// The returned error only covers saving: once saved, failed processing is recorded in the inbox
+// and retried by ProcessMessages, so the delivery can be acknowledged.
+func (p *InboxProcessor) ReceiveMessage(eventName string, payload datatypes.JSON) error {
+	return p.ReceiveMessageWithID("", eventName, payload)
+}
+
+// ReceiveMessageWithID is ReceiveMessage deduplicated on messageID, such as the AMQP MessageId.
+// Messages without an ID are deduplicated on their content hash.
+func (p *InboxProcessor) ReceiveMessageWithID(messageID, eventName string, payload datatypes.JSON, opts ...MessageOption) error {
+	id, created, err := p.saveMessage(messageID, eventName, payload, opts...)
+	if err != nil {
+		return err
+	}
+
+	// The next ProcessMessages run picks the message up when shutting down
+	if !created || !p.ProcessOnReceive || !p.beginBatch() {
+		return nil
+	}
+	defer p.inflight.Done()
+
+	messages, err := p.claimMessages(id)
+	if err != nil {
+		log.Printf("Error claiming inbox message %s, leaving it to the sweep: %v\n", id, err)
+		return nil
+	}
+
+	// Nothing claimed when an earlier message with the same ordering key is still pending
+	p.processMessages(messages)
+
+	return nil
+}
+
+// SaveMessage saves a message to the inbox with idempotency checks
+func (p *InboxProcessor) SaveMessage(eventName string, payload datatypes.JSON) error {
+	return p.SaveMessageWithID("", eventName, payload)
+}
+
+// SaveMessageWithID saves a message to the inbox, deduplicated on messageID when it is set
+func (p *InboxProcessor) SaveMessageWithID(messageID, eventName string, payload datatypes.JSON, opts ...MessageOption) error {
+	_, _, err := p.saveMessage(messageID, eventName, payload, opts...)
+	return err
+}
+
+// saveMessage returns the inbox ID of the message and whether it was created or already existed
+func (p *InboxProcessor) saveMessage(messageID, eventName string, payload datatypes.JSON, opts ...MessageOption) (string, bool, error) {
+	// Generate a deterministic message ID from the publisher's message ID, or else the event content
+	id := GenerateContentHash(eventName, p.ConsumerName, payload)
+	dedupIDs := []string{id}
+	if messageID != "" {
+		// Messages received before publishers sent a MessageId were saved under their content hash,
+		// which still catches a redelivery of such an event that now carries a MessageId
+		id = GenerateMessageIDHash(messageID, p.ConsumerName)
+		dedupIDs = []string{id, dedupIDs[0]}
+	}
+
+	// First check if the message already exists
+	var existing InboxMessage
+	result := p.DB.Where("id IN ?", dedupIDs).First(&existing)
+
+	// If found, it's a duplicate
+	if result.Error == nil {
+		log.Printf("Duplicate message detected with ID: %s", existing.ID)
+		return existing.ID, false, nil
+	}
+
+	// If error is not "record not found", it's a database error
+	if !errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return "", false, result.Error
+	}
+
+	// Processed messages removed by retention leave their ID behind
+	var dedupKeys int64
+	if err := p.DB.Model(&InboxDedupKey{}).Where("id IN ?", dedupIDs).Count(&dedupKeys).Error; err != nil {
+		return "", false, err
+	}
+	if dedupKeys > 0 {
+		log.Printf("Duplicate message detected with compacted ID: %s", id)
+		return id, false, nil
+	}
+
+	// The Message doesn't exist, create it
+	inboxMessage := InboxMessage{
+		ID:              id,
+		Consumer:        p.ConsumerName,
+		MessageID:       messageID,
+		EventName:       eventName,
+		Payload:         payload,
+		IsProcessed:     false,
+		Status:          InboxStatusPending,
+		ProcessingCount: 0,
+	}
+
+	if p.OrderingKey != nil {
+		inboxMessage.OrderingKey = p.OrderingKey(eventName, payload)
+	}
+
+	for _, opt := range opts {
+		opt(&inboxMessage)
+	}
+
+	// Messages that expired in transit are recorded but never handled
+	if now := time.Now(); inboxMessage.Expired(now) {
+		inboxMessage.Status = InboxStatusExpired
+		inboxMessage.ExpiredAt = &now
+		log.Printf("Inbox message %s [%s] expired at %s before it was received\n",
+			id, eventName, inboxMessage.ExpiresAt.Format(time.RFC3339))
+	}
+
+	if err := p.DB.Create(&inboxMessage).Error; err != nil {
+		return "", false, err
+	}
+
+	return id, true, nil
+}
+
+// ProcessMessages claims and processes due inbox messages with a pool of goroutines
+// until no due messages are left
+func (p *InboxProcessor) ProcessMessages() {
+	concurrency := p.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p.beginBatch() {
+				messages, err := p.claimMessages()
+				if err != nil {
+					p.inflight.Done()
+					log.Println("Error claiming inbox messages:", err)
+					return
+				}
+
+				if len(messages) == 0 {
+					p.inflight.Done()
+					return
+				}
+
+				p.processMessages(messages)
+				p.inflight.Done()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// claimMessages locks a batch of due messages for this worker, limited to the given IDs if any.
+// SKIP LOCKED lets concurrent goroutines and replicas claim disjoint batches without waiting on each other.
+func (p *InboxProcessor) claimMessages(ids ...string) ([]InboxMessage, error) {
+	batchSize := p.BatchSize
+	if batchSize < 1 {
+		batchSize = _defaultBatchSize
+	}
+
+	leaseDuration := p.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = _defaultLeaseDuration
+	}
+
+	var messages []InboxMessage
+	err := p.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("consumer = ? AND status = ?", p.ConsumerName, InboxStatusPending).
+			Where("next_attempt_at IS NULL OR next_attempt_at <= ?", now).
+			Where("locked_until IS NULL OR locked_until <= ?", now)
+
+		if len(ids) > 0 {
+			query = query.Where("id IN ?", ids)
+		}
+
+		if p.OrderingKey != nil {
+			query = query.Where(`ordering_key = '' OR NOT EXISTS (
+				SELECT 1 FROM inbox_messages earlier
+				WHERE earlier.consumer = inbox_messages.consumer
+				AND earlier.ordering_key = inbox_messages.ordering_key
+				AND earlier.status = ?
+				AND earlier.received_at < inbox_messages.received_at)`, InboxStatusPending)
+		}
+
+		if err := query.Order("priority DESC, received_at ASC").
+			Limit(batchSize).
+			Find(&messages).Error; err != nil {
+			return err
+		}
+
+		if len(messages) == 0 {
+			return nil
+		}
+
+		claimedIDs := make([]string, 0, len(messages))
+		for i := range messages {
+			claimedIDs = append(claimedIDs, messages[i].ID)
+			messages[i].ProcessingCount++
+		}
+
+		// Claiming counts as an attempt so a crash mid-handler still uses one up
+		return tx.Model(&InboxMessage{}).
+			Where("id IN ?", claimedIDs).
+			Updates(map[string]interface{}{
+				"locked_by":        lockOwner(),
+				"locked_until":     now.Add(leaseDuration),
+				"processing_count": gorm.Expr("processing_count + 1"),
+				"last_attempt_at":  now,
+				"first_attempt_at": gorm.Expr("COALESCE(first_attempt_at, ?)", now),
+			}).Error
+	})
+
+	return messages, err
+}
+
+// processMessages handles claimed messages one by one, except for events the handler
+// accepts in bulk, which are passed to HandleBatch grouped by event name
+func (p *InboxProcessor) processMessages(messages []InboxMessage) {
+	batchHandler, ok := p.Handler.(BatchHandler)
+	if !ok {
+		for _, msg := range messages {
+			p.processMessage(msg)
+		}
+		return
+	}
+
+	batches := make(map[string][]InboxMessage)
+	var eventNames []string
+	for _, msg := range messages {
+		if p.skipExpired(msg) {
+			continue
+		}
+		if !batchHandler.HandlesBatch(msg.EventName) {
+			p.processMessage(msg)
+			continue
+		}
+		if _, ok := batches[msg.EventName]; !ok {
+			eventNames = append(eventNames, msg.EventName)
+		}
+		batches[msg.EventName] = append(batches[msg.EventName], msg)
+	}
+
+	for _, eventName := range eventNames {
+		p.processBatch(batchHandler, eventName, batches[eventName])
+	}
+}
+
+// processMessage runs the handler for a claimed message and records the outcome
+func (p *InboxProcessor) processMessage(msg InboxMessage) {
+	if p.skipExpired(msg) {
+		return
+	}
+
+	middlewares := make([]Middleware, 0, len(p.Middlewares)+2)
+	middlewares = append(middlewares, Recover())
+	middlewares = append(middlewares, p.Middlewares...)
+	middlewares = append(middlewares, EventTimeout(p.HandlerTimeout, p.EventTimeouts))
+
+	ctx := p.baseContext()
+	handler := Chain(p.Handler, middlewares...)
+	err := handler.HandleMessage(ctx, msg.EventName, msg.Payload)
+	p.recordResult(ctx, msg, err)
+}
+
+// processBatch runs HandleBatch for claimed messages of one event and records the outcome of each message.
+// Middlewares do not apply to batches, but panics are recovered and the event timeout covers the whole batch.
+func (p *InboxProcessor) processBatch(handler BatchHandler, eventName string, messages []InboxMessage) {
+	ctx := p.baseContext()
+	batchCtx := ctx
+	if d := p.timeoutFor(eventName); d > 0 {
+		var cancel context.CancelFunc
+		batchCtx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	errs := func() (errs []error) {
+		defer func() {
+			if r := recover(); r != nil {
+				batchErr := fmt.Errorf("%w: %v\n%s", ErrHandlerPanic, r, debug.Stack())
+				errs = make([]error, len(messages))
+				for i := range errs {
+					errs[i] = batchErr
+				}
+			}
+		}()
+		return handler.HandleBatch(batchCtx, eventName, messages)
+	}()
+
+	if errs != nil && len(errs) != len(messages) {
+		batchErr := fmt.Errorf("batch handler for %s returned %d results for %d messages", eventName, len(errs), len(messages))
+		errs = make([]error, len(messages))
+		for i := range errs {
+			errs[i] = batchErr
+		}
+	}
+
+	for i, msg := range messages {
+		var err error
+		if errs != nil {
+			err = errs[i]
+		}
+		if err != nil && errors.Is(batchCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w after %s: %w", ErrHandlerTimeout, p.timeoutFor(eventName), err)
+		}
+		p.recordResult(ctx, msg, err)
+	}
+}
+
+// recordResult stores the outcome of handling a claimed message
+func (p *InboxProcessor) recordResult(ctx context.Context, msg InboxMessage, err error) {
+	if err != nil {
+		log.Printf("Failed to process inbox message %s: %v\n", msg.ID, err)
+		if ctx.Err() != nil {
+			p.releaseMessage(msg.ID, msg.ProcessingCount, err)
+			return
+		}
+		p.recordFailure(msg.ID, msg.ProcessingCount, err)
+		return
+	}
+
+	// Mark as processed
+	now := time.Now()
+	if owned, err := p.updateClaimed(msg.ID, msg.ProcessingCount, map[string]interface{}{
+		"is_processed":    true,
+		"status":          InboxStatusProcessed,
+		"processed_at":    now,
+		"next_attempt_at": nil,
+		"locked_until":    nil,
+	}); err != nil {
+		log.Println("Error marking inbox message as processed:", err)
+	} else if owned {
+		log.Printf("Successfully processed inbox message: %s\n", msg.ID)
+	}
+}
+
+// skipExpired marks a claimed message expired instead of handling it once it passed its expiry
+func (p *InboxProcessor) skipExpired(msg InboxMessage) bool {
+	now := time.Now()
+	if !msg.Expired(now) {
+		return false
+	}
+
+	if owned, err := p.updateClaimed(msg.ID, msg.ProcessingCount, map[string]interface{}{
+		"status":          InboxStatusExpired,
+		"expired_at":      now,
+		"next_attempt_at": nil,
+		"locked_until":    nil,
+	}); err != nil {
+		log.Println("Error marking inbox message as expired:", err)
+	} else if owned {
+		log.Printf("Skipped inbox message %s [%s], expired at %s\n",
+			msg.ID, msg.EventName, msg.ExpiresAt.Format(time.RFC3339))
+	}
+	return true
+}
+
+// recordFailure stores the error of a failed attempt and schedules the next one with backoff.
+// The message is parked when the error is permanent or the attempts are used up.
+func (p *InboxProcessor) recordFailure(id string, attempts int, cause error) {
+	policy := p.retryPolicy()
+	now := time.Now()
+	updateFields := map[string]interface{}{
+		"last_error":   cause.Error(),
+		"locked_until": nil,
+	}
+
+	park := errors.Is(cause, ErrParked) || attempts >= policy.MaxAttempts
+	if park {
+		updateFields["status"] = InboxStatusParked
+		updateFields["parked_at"] = now
+		updateFields["next_attempt_at"] = nil
+	} else {
+		updateFields["next_attempt_at"] = now.Add(policy.Backoff(attempts))
+	}
+
+	if owned, err := p.updateClaimed(id, attempts, updateFields); err != nil {
+		log.Println("Error recording inbox message failure:", err)
+	} else if owned && park {
+		log.Printf("Parked inbox message %s after %d attempts: %v\n", id, attempts, cause)
+	}
+}
+
+// releaseMessage unlocks a message interrupted by Shutdown so the next run can pick it up right away
+func (p *InboxProcessor) releaseMessage(id string, attempts int, cause error) {
+	if _, err := p.updateClaimed(id, attempts, map[string]interface{}{
+		"last_error":   cause.Error(),
+		"locked_until": nil,
+	}); err != nil {
+		log.Println("Error releasing inbox message:", err)
+	}
+}
+
+// updateClaimed updates a message only while the attempt that claimed it still holds the lock.
+// It reports false when the lease ran out and another worker claimed the message meanwhile,
+// so a slow handler never overwrites the outcome of the newer attempt.
+func (p *InboxProcessor) updateClaimed(id string, attempts int, fields map[string]interface{}) (bool, error) {
+	result := p.DB.Model(&InboxMessage{}).
+		Where("id = ? AND locked_by = ? AND processing_count = ?", id, lockOwner(), attempts).
+		Updates(fields)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		log.Printf("Inbox message %s is no longer locked by %s, dropping the result\n", id, lockOwner())
+		return false, nil
+	}
+	return true, nil
+}
+
+// timeoutFor returns the handler deadline of an event, zero for no deadline
+func (p *InboxProcessor) timeoutFor(eventName string) time.Duration {
+	if d, ok := p.EventTimeouts[eventName]; ok {
+		return d
+	}
+	return p.HandlerTimeout
+}
+
+func (p *InboxProcessor) retryPolicy() RetryPolicy {
+	if p.RetryPolicy.MaxAttempts == 0 {
+		return DefaultRetryPolicy
+	}
+	return p.RetryPolicy
+}
+
+// lockOwner identifies this process in the locked_by column
+func lockOwner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
@@ -0,0 +1,97 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ReplayFilter selects the inbox messages of a consumer to replay.
+// At least one of EventNames, From, To or IDs must be set.
+type ReplayFilter struct {
+	Consumer   string
+	EventNames []string
+	// From and To limit the time the messages were received, zero means unbounded
+	From time.Time
+	To   time.Time
+	IDs  []string
+}
+
+// ReplaySafetyChecker tells whether the handler of an event can safely run again, see ReplaySafe
+type ReplaySafetyChecker interface {
+	IsReplaySafe(eventName string) bool
+}
+
+// ReplayMessages resets processed and parked messages matching filter to pending, so the worker
+// processes them again. With dryRun the matching messages are returned without changing anything.
+// It refuses to replay when any matching message belongs to a handler that is not replay safe.
+func ReplayMessages(db *gorm.DB, checker ReplaySafetyChecker, filter ReplayFilter, dryRun bool) ([]InboxMessage, error) {
+	if filter.Consumer == "" {
+		return nil, errors.New("replay requires a consumer")
+	}
+	if len(filter.EventNames) == 0 && filter.From.IsZero() && filter.To.IsZero() && len(filter.IDs) == 0 {
+		return nil, errors.New("replay requires an event name, time range or message ID")
+	}
+
+	query := db.Model(&InboxMessage{}).
+		Where("consumer = ? AND status IN ?", filter.Consumer, []string{InboxStatusProcessed, InboxStatusParked})
+	if len(filter.EventNames) > 0 {
+		query = query.Where("event_name IN ?", filter.EventNames)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("received_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("received_at < ?", filter.To)
+	}
+	if len(filter.IDs) > 0 {
+		query = query.Where("id IN ?", filter.IDs)
+	}
+
+	var messages []InboxMessage
+	if err := query.Order("received_at ASC").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	unsafeEvents := make(map[string]bool)
+	for _, msg := range messages {
+		if !checker.IsReplaySafe(msg.EventName) {
+			unsafeEvents[msg.EventName] = true
+		}
+	}
+	if len(unsafeEvents) > 0 {
+		names := make([]string, 0, len(unsafeEvents))
+		for name := range unsafeEvents {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return messages, fmt.Errorf("handlers of %s are not marked replay safe", strings.Join(names, ", "))
+	}
+
+	if dryRun || len(messages) == 0 {
+		return messages, nil
+	}
+
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+
+	err := db.Model(&InboxMessage{}).
+		Where("id IN ?", ids).
+		Updates(map[string]interface{}{
+			"is_processed":     false,
+			"status":           InboxStatusPending,
+			"processing_count": 0,
+			"next_attempt_at":  nil,
+			"locked_until":     nil,
+			"last_error":       "",
+			"processed_at":     nil,
+			"parked_at":        nil,
+		}).Error
+	return messages, err
+}
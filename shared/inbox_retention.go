@@ -0,0 +1,225 @@
+package shared
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	_defaultRetentionBatchSize = 1000
+)
+
+// InboxDedupKey remembers the ID of a processed inbox message after its row is removed,
+// so redeliveries inside the dedup window are still detected as duplicates
+type InboxDedupKey struct {
+	ID          string    `gorm:"primaryKey" json:"id"`
+	Consumer    string    `gorm:"size:64;index" json:"consumer"`
+	ProcessedAt time.Time `gorm:"index" json:"processed_at"`
+}
+
+// InboxCounts is the number of inbox rows of a consumer by status
+type InboxCounts struct {
+	Pending   int64
+	Processed int64
+	Parked    int64
+	Expired   int64
+	DedupKeys int64
+}
+
+// CountInbox returns the inbox row counts of a consumer
+func CountInbox(db *gorm.DB, consumerName string) (InboxCounts, error) {
+	var counts InboxCounts
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+
+	err := db.Model(&InboxMessage{}).
+		Select("status, COUNT(*) AS count").
+		Where("consumer = ?", consumerName).
+		Group("status").
+		Scan(&rows).Error
+	if err != nil {
+		return counts, err
+	}
+
+	for _, row := range rows {
+		switch row.Status {
+		case InboxStatusPending:
+			counts.Pending = row.Count
+		case InboxStatusProcessed:
+			counts.Processed = row.Count
+		case InboxStatusParked:
+			counts.Parked = row.Count
+		case InboxStatusExpired:
+			counts.Expired = row.Count
+		}
+	}
+
+	err = db.Model(&InboxDedupKey{}).
+		Where("consumer = ?", consumerName).
+		Count(&counts.DedupKeys).Error
+	return counts, err
+}
+
+// RetentionResult is what a single InboxRetention run removed, plus the counts left afterwards
+type RetentionResult struct {
+	DeletedMessages  int64
+	CompactedKeys    int64
+	ExpiredDedupKeys int64
+	Counts           InboxCounts
+}
+
+// InboxRetention removes processed and expired inbox messages once they are older than the retention window.
+// Pending and parked messages are never removed.
+type InboxRetention struct {
+	DB           *gorm.DB
+	ConsumerName string
+
+	// Window is how long processed messages are kept, retention is disabled when zero
+	Window time.Duration
+	// CompactDedupKeys keeps the ID of removed messages in inbox_dedup_keys
+	CompactDedupKeys bool
+	// DedupWindow is how long compacted dedup keys are kept
+	DedupWindow time.Duration
+	// BatchSize is the number of rows removed per statement
+	BatchSize int
+}
+
+// ConfigureFromEnv applies INBOX_RETENTION, INBOX_COMPACT_DEDUP_KEYS and INBOX_DEDUP_WINDOW
+func (r *InboxRetention) ConfigureFromEnv() error {
+	if v := os.Getenv("INBOX_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid INBOX_RETENTION %q: %w", v, err)
+		}
+		r.Window = d
+	}
+
+	if v := os.Getenv("INBOX_COMPACT_DEDUP_KEYS"); v != "" {
+		compact, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid INBOX_COMPACT_DEDUP_KEYS %q", v)
+		}
+		r.CompactDedupKeys = compact
+	}
+
+	if v := os.Getenv("INBOX_DEDUP_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid INBOX_DEDUP_WINDOW %q: %w", v, err)
+		}
+		r.DedupWindow = d
+	}
+
+	return nil
+}
+
+// Run removes expired rows and logs the result, meant to be scheduled with cron
+func (r *InboxRetention) Run() {
+	if r.Window <= 0 {
+		return
+	}
+
+	result, err := r.Cleanup(time.Now())
+	if err != nil {
+		log.Println("Error cleaning up inbox:", err)
+		return
+	}
+
+	log.Printf("Inbox retention for %s: deleted=%d compacted=%d expired_keys=%d pending=%d processed=%d parked=%d expired=%d dedup_keys=%d\n",
+		r.ConsumerName, result.DeletedMessages, result.CompactedKeys, result.ExpiredDedupKeys,
+		result.Counts.Pending, result.Counts.Processed, result.Counts.Parked, result.Counts.Expired, result.Counts.DedupKeys)
+}
+
+// Cleanup removes processed and expired messages older than the window and dedup keys older than the dedup window
+func (r *InboxRetention) Cleanup(now time.Time) (RetentionResult, error) {
+	var result RetentionResult
+
+	batchSize := r.BatchSize
+	if batchSize < 1 {
+		batchSize = _defaultRetentionBatchSize
+	}
+
+	cutoff := now.Add(-r.Window)
+	for {
+		var messages []InboxMessage
+		err := r.DB.Select("id", "consumer", "processed_at", "expired_at").
+			Where("consumer = ?", r.ConsumerName).
+			Where("(status = ? AND processed_at < ?) OR (status = ? AND expired_at < ?)",
+				InboxStatusProcessed, cutoff, InboxStatusExpired, cutoff).
+			Limit(batchSize).
+			Find(&messages).Error
+		if err != nil {
+			return result, err
+		}
+
+		if len(messages) == 0 {
+			break
+		}
+
+		ids := make([]string, 0, len(messages))
+		for _, msg := range messages {
+			ids = append(ids, msg.ID)
+		}
+
+		err = r.DB.Transaction(func(tx *gorm.DB) error {
+			if r.CompactDedupKeys {
+				keys := dedupKeys(messages)
+				compacted := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&keys)
+				if compacted.Error != nil {
+					return compacted.Error
+				}
+				result.CompactedKeys += compacted.RowsAffected
+			}
+
+			deleted := tx.Where("id IN ?", ids).Delete(&InboxMessage{})
+			if deleted.Error != nil {
+				return deleted.Error
+			}
+			result.DeletedMessages += deleted.RowsAffected
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+
+		if len(ids) < batchSize {
+			break
+		}
+	}
+
+	if r.DedupWindow > 0 {
+		expired := r.DB.Where("consumer = ? AND processed_at < ?", r.ConsumerName, now.Add(-r.DedupWindow)).
+			Delete(&InboxDedupKey{})
+		if expired.Error != nil {
+			return result, expired.Error
+		}
+		result.ExpiredDedupKeys = expired.RowsAffected
+	}
+
+	counts, err := CountInbox(r.DB, r.ConsumerName)
+	result.Counts = counts
+	return result, err
+}
+
+// dedupKeys returns the dedup keys of removed messages, expired messages keeping their expiry time
+func dedupKeys(messages []InboxMessage) []InboxDedupKey {
+	keys := make([]InboxDedupKey, 0, len(messages))
+	for _, msg := range messages {
+		key := InboxDedupKey{ID: msg.ID, Consumer: msg.Consumer}
+		if msg.ProcessedAt != nil {
+			key.ProcessedAt = *msg.ProcessedAt
+		} else if msg.ExpiredAt != nil {
+			key.ProcessedAt = *msg.ExpiredAt
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
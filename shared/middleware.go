@@ -0,0 +1,136 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+var (
+	// ErrHandlerPanic is returned by Recover when a handler panics
+	ErrHandlerPanic = errors.New("handler panicked")
+	// ErrHandlerTimeout is returned by Timeout when a handler misses its deadline
+	ErrHandlerTimeout = errors.New("handler timed out")
+)
+
+// HandlerFunc adapts an ordinary function to MessageHandler
+type HandlerFunc func(ctx context.Context, eventName string, payload datatypes.JSON) error
+
+// HandleMessage implements MessageHandler
+func (f HandlerFunc) HandleMessage(ctx context.Context, eventName string, payload datatypes.JSON) error {
+	return f(ctx, eventName, payload)
+}
+
+// Middleware wraps a MessageHandler with cross-cutting behaviour
+type Middleware func(next MessageHandler) MessageHandler
+
+// Chain wraps h with the middlewares. The first middleware is the outermost one.
+func Chain(h MessageHandler, middlewares ...Middleware) MessageHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Recover turns a panicking handler into an ErrHandlerPanic error carrying the panic value and stack
+func Recover() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return HandlerFunc(func(ctx context.Context, eventName string, payload datatypes.JSON) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%w: %v\n%s", ErrHandlerPanic, r, debug.Stack())
+				}
+			}()
+			return next.HandleMessage(ctx, eventName, payload)
+		})
+	}
+}
+
+// Timing reports how long each handler call took to observe, e.g. to feed a metrics histogram
+func Timing(observe func(eventName string, duration time.Duration, err error)) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return HandlerFunc(func(ctx context.Context, eventName string, payload datatypes.JSON) error {
+			start := time.Now()
+			err := next.HandleMessage(ctx, eventName, payload)
+			observe(eventName, time.Since(start), err)
+			return err
+		})
+	}
+}
+
+// Logging logs the outcome and duration of each handler call
+func Logging() Middleware {
+	return Timing(func(eventName string, duration time.Duration, err error) {
+		if err != nil {
+			log.Printf("Handler [%s] failed after %s: %v\n", eventName, duration, err)
+			return
+		}
+		log.Printf("Handler [%s] succeeded in %s\n", eventName, duration)
+	})
+}
+
+// Timeout gives every handler call a deadline of d
+func Timeout(d time.Duration) Middleware {
+	return EventTimeout(d, nil)
+}
+
+// EventTimeout gives handler calls the deadline configured for their event in timeouts,
+// or defaultTimeout for other events. A zero duration means no deadline.
+// Calls that miss the deadline fail with ErrHandlerTimeout, even if the handler ignores ctx
+// and keeps running in the background.
+func EventTimeout(defaultTimeout time.Duration, timeouts map[string]time.Duration) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return HandlerFunc(func(ctx context.Context, eventName string, payload datatypes.JSON) error {
+			d, ok := timeouts[eventName]
+			if !ok {
+				d = defaultTimeout
+			}
+			if d <= 0 {
+				return next.HandleMessage(ctx, eventName, payload)
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- Recover()(next).HandleMessage(ctx, eventName, payload)
+			}()
+
+			select {
+			case err := <-done:
+				if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return fmt.Errorf("%w after %s: %w", ErrHandlerTimeout, d, err)
+				}
+				return err
+			case <-ctx.Done():
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return fmt.Errorf("%w after %s", ErrHandlerTimeout, d)
+				}
+				return ctx.Err()
+			}
+		})
+	}
+}
+
+// Tracer starts a span for a handler call. The returned function ends the span with the call's error.
+type Tracer interface {
+	Start(ctx context.Context, eventName string) (context.Context, func(err error))
+}
+
+// Tracing wraps each handler call in a span of tracer, passing the span's context to the handler
+func Tracing(tracer Tracer) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return HandlerFunc(func(ctx context.Context, eventName string, payload datatypes.JSON) error {
+			ctx, end := tracer.Start(ctx, eventName)
+			err := next.HandleMessage(ctx, eventName, payload)
+			end(err)
+			return err
+		})
+	}
+}
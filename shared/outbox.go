@@ -1,8 +1,16 @@
 package shared
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"outbox/queue"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/streadway/amqp"
@@ -11,24 +19,117 @@ import (
 )
 
 type OutBoxMessage struct {
-	ID          string         `gorm:"id" json:"id"`
-	EventName   string         `gorm:"event_name" json:"event_name"`
-	Payload     datatypes.JSON `gorm:"payload" json:"payload"`
-	IsProcessed bool           `gorm:"is_processed" json:"is_processed"`
+	ID            string         `gorm:"id" json:"id"`
+	AggregateType string         `gorm:"aggregate_type" json:"aggregate_type"`
+	EventName     string         `gorm:"event_name" json:"event_name"`
+	Payload       datatypes.JSON `gorm:"payload" json:"payload"`
+	IsProcessed   bool           `gorm:"is_processed" json:"is_processed"`
+	// Priority is published as the AMQP priority, 0 to 9 with priority queues declared by queue.WorkerTopology
+	Priority uint8 `gorm:"priority" json:"priority"`
+	// ExpiresAt drops the message when it is not consumed in time, nil never expires
+	ExpiresAt *time.Time `gorm:"expires_at" json:"expires_at,omitempty"`
+	// SentAt is when the relay published the message, nil for pending or dropped messages
+	SentAt *time.Time `gorm:"sent_at" json:"-"`
+	// ContentEncoding is how CompressedPayload is compressed, empty when Payload is stored as is
+	ContentEncoding string `gorm:"size:16" json:"-"`
+	// CompressedPayload replaces Payload once Compress compressed it
+	CompressedPayload []byte `gorm:"type:longblob" json:"-"`
+}
+
+// Compress stores the payload compressed when the compression settings select an encoding for it
+func (m *OutBoxMessage) Compress(c Compression) error {
+	encoding := c.EncodingFor(m.EventName, len(m.Payload))
+	if encoding == "" || m.ContentEncoding != "" {
+		return nil
+	}
+
+	compressed, err := Compress(encoding, m.Payload)
+	if err != nil {
+		return fmt.Errorf("compress %s payload: %w", m.EventName, err)
+	}
+
+	m.ContentEncoding = encoding
+	m.CompressedPayload = compressed
+	m.Payload = nil
+	return nil
+}
+
+// wireBody returns the message as published, compressed with the encoding of the stored payload
+func (m OutBoxMessage) wireBody() ([]byte, error) {
+	if m.ContentEncoding == "" {
+		return json.Marshal(m)
+	}
+
+	payload, err := Decompress(m.ContentEncoding, m.CompressedPayload)
+	if err != nil {
+		return nil, fmt.Errorf("decompress payload: %w", err)
+	}
+	m.Payload = payload
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return Compress(m.ContentEncoding, b)
+}
+
+// DefaultMarkRetryPolicy is used when an OutboxProcessor has no MarkRetryPolicy set
+var DefaultMarkRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+	Jitter:      0.2,
+}
+
+const _defaultMarkChunkSize = 10
+
+// HeaderDeduplication is the header the RabbitMQ message deduplication plugin deduplicates on
+const HeaderDeduplication = "x-deduplication-header"
+
+// ChannelProvider returns the channel to publish on, such as queue.ConnectionManager
+// which replaces the channel after a reconnect
+type ChannelProvider interface {
+	Channel() (*amqp.Channel, error)
 }
 
 type OutboxProcessor struct {
-	DB           *gorm.DB
-	Channel      *amqp.Channel
-	Queue        amqp.Queue
-	Exchange     string
+	DB       *gorm.DB
+	Channels ChannelProvider
+	Exchange string
+	// ExchangeType is fanout or topic. Messages are published to a topic exchange with their RoutingKey.
 	ExchangeType string
+	// DeduplicationHeader also sends the outbox ID in the x-deduplication-header header read by
+	// the RabbitMQ message deduplication plugin
+	DeduplicationHeader bool
+	// ConfirmTimeout is how long to wait for the broker to confirm a message, 10s when unset
+	ConfirmTimeout time.Duration
+	// MarkChunkSize is how many published messages are marked as sent at once, 10 when unset.
+	// If marking fails for good, only the messages of that chunk are published again.
+	MarkChunkSize int
+	// MarkRetryPolicy retries marking a chunk before the run gives up, DefaultMarkRetryPolicy when unset
+	MarkRetryPolicy RetryPolicy
+	// Publish publishes a message and returns once the broker confirmed it. When nil messages are
+	// published as mandatory on the channel of Channels in confirm mode.
+	Publish func(exchange, routingKey string, msg amqp.Publishing) error
+
+	mu         sync.Mutex
+	stopping   atomic.Bool
+	confirmed  *queue.ConfirmedPublisher
+	unroutable map[string]int
 }
 
 func (p *OutboxProcessor) HandleOutboxMessage() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopping.Load() {
+		return
+	}
+
 	messages := make([]OutBoxMessage, 0)
 	err := p.DB.
 		Where("is_processed = ?", false).
+		Order("priority DESC").
 		Find(&messages).Error
 	if err != nil {
 		log.Println("query outbox messages error: ", err)
@@ -40,47 +141,239 @@ func (p *OutboxProcessor) HandleOutboxMessage() {
 		return
 	}
 
+	// Messages stay pending while RabbitMQ is unreachable
+	publish, err := p.publisher()
+	if err != nil {
+		log.Println("get publishing channel error: ", err)
+		return
+	}
+
+	chunkSize := p.MarkChunkSize
+	if chunkSize < 1 {
+		chunkSize = _defaultMarkChunkSize
+	}
+
 	// Publish each message.
-	// If success, add to processed slice
-	processedID := make([]string, 0)
+	// Confirmed messages routed to a queue are marked as sent every chunkSize messages, so a failed
+	// update only republishes that chunk -> duplicates are handled at consumer with an inbox pattern
+	sentID := make([]string, 0, chunkSize)
 	for _, m := range messages {
-		b, err := json.Marshal(m)
+		// Stop publishing when shutting down, the published messages are still marked below
+		if p.stopping.Load() {
+			break
+		}
+
+		// Expired messages are worthless to consumers, drop them without publishing
+		if m.ExpiresAt != nil && !time.Now().Before(*m.ExpiresAt) {
+			log.Printf("Outbox message %s [%s] expired at %s before it was published, dropping it\n",
+				m.ID, m.EventName, m.ExpiresAt.Format(time.RFC3339))
+			if err := p.markProcessed([]string{m.ID}, false); err != nil {
+				log.Println("update outbox error: ", err)
+			}
+			continue
+		}
+
+		b, err := m.wireBody()
 		if err != nil {
+			log.Printf("encode outbox message %s error: %v\n", m.ID, err)
 			continue
 		}
 
 		// publish a message to a queue
-		if err := p.publishMessage(b); err != nil {
+		err = p.publishMessage(publish, m, b)
+		if errors.Is(err, queue.ErrUnroutable) {
+			p.recordUnroutable(m, err)
+			continue
+		}
+		if err != nil {
 			log.Println("publish outbox message error: ", err)
+			// A late confirmation cannot be told apart from the next one, retry the rest on the next run
+			if errors.Is(err, queue.ErrConfirmTimeout) {
+				break
+			}
 			continue
 		}
 
-		processedID = append(processedID, m.ID)
+		sentID = append(sentID, m.ID)
+		if len(sentID) < chunkSize {
+			continue
+		}
+
+		// Publishing more while the database is failing would only grow the duplicates
+		if err := p.markProcessed(sentID, true); err != nil {
+			log.Println("update outbox error, stopping this run: ", err)
+			return
+		}
+		log.Println("Published messages:", sentID)
+		sentID = sentID[:0]
 	}
 
-	// Update processed messages in database
-	// If error, duplicate the messages -> handle at consumer with an inbox pattern
-	err = p.DB.Model(&OutBoxMessage{}).
-		Where("id IN ?", processedID).
-		UpdateColumn("is_processed", true).Error
-	if err != nil {
+	if len(sentID) == 0 {
+		return
+	}
+
+	if err := p.markProcessed(sentID, true); err != nil {
 		log.Println("update outbox error: ", err)
 		return
 	}
+	log.Println("Published messages:", sentID)
+}
+
+// markProcessed sets is_processed, and sent_at for published messages, retrying with backoff
+func (p *OutboxProcessor) markProcessed(ids []string, sent bool) error {
+	policy := p.MarkRetryPolicy
+	if policy.MaxAttempts == 0 {
+		policy = DefaultMarkRetryPolicy
+	}
 
-	log.Println("Published messages:", processedID)
+	updates := map[string]interface{}{"is_processed": true}
+	if sent {
+		updates["sent_at"] = time.Now()
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = p.DB.Model(&OutBoxMessage{}).
+			Where("id IN ?", ids).
+			Updates(updates).Error
+		if err == nil || attempt >= policy.MaxAttempts {
+			break
+		}
+
+		delay := policy.Backoff(attempt)
+		log.Printf("Marking %d outbox messages failed (attempt %d), retrying in %s: %v\n", len(ids), attempt, delay, err)
+		time.Sleep(delay)
+	}
+
+	if err != nil {
+		return fmt.Errorf("mark %d outbox messages after %d attempts: %w", len(ids), policy.MaxAttempts, err)
+	}
+	return nil
+}
+
+// ConfigureFromEnv applies OUTBOX_DEDUPLICATION_HEADER and OUTBOX_MARK_CHUNK_SIZE
+func (p *OutboxProcessor) ConfigureFromEnv() error {
+	if v := os.Getenv("OUTBOX_MARK_CHUNK_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid OUTBOX_MARK_CHUNK_SIZE %q", v)
+		}
+		p.MarkChunkSize = n
+	}
+
+	if v := os.Getenv("OUTBOX_DEDUPLICATION_HEADER"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid OUTBOX_DEDUPLICATION_HEADER %q", v)
+		}
+		p.DeduplicationHeader = enabled
+	}
+	return nil
 }
 
-func (p *OutboxProcessor) publishMessage(body []byte) error {
-	return p.Channel.Publish(
-		p.Exchange, // fanout
-		"",         // routing key - empty for fanout exchange
-		false,      // mandatory
-		false,      // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Timestamp:   time.Now(),
-			Body:        body,
-		},
-	)
+// Shutdown stops publishing and waits until the current run marked the messages it already published
+// as processed, or ctx is done
+func (p *OutboxProcessor) Shutdown(ctx context.Context) error {
+	p.stopping.Store(true)
+
+	done := make(chan struct{})
+	go func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		close(done)
+	}()
+
+	if err := WaitDone(ctx, done); err != nil {
+		return fmt.Errorf("waiting for the outbox run: %w", err)
+	}
+	return nil
+}
+
+// UnroutableEvents returns how many messages of each event name were returned by the broker
+// because no queue was bound to receive them
+func (p *OutboxProcessor) UnroutableEvents() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counts := make(map[string]int, len(p.unroutable))
+	for eventName, count := range p.unroutable {
+		counts[eventName] = count
+	}
+	return counts
+}
+
+// confirmedPublisher returns the publisher of the publishing channel in confirm mode, enabling it again
+// when the provider replaced the channel after a reconnect
+func (p *OutboxProcessor) confirmedPublisher() (*queue.ConfirmedPublisher, error) {
+	ch, err := p.Channels.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.confirmed == nil || p.confirmed.Channel() != ch {
+		confirmed, err := queue.NewConfirmedPublisher(ch)
+		if err != nil {
+			return nil, err
+		}
+		confirmed.Timeout = p.ConfirmTimeout
+		p.confirmed = confirmed
+	}
+
+	return p.confirmed, nil
+}
+
+func (p *OutboxProcessor) recordUnroutable(m OutBoxMessage, err error) {
+	if p.unroutable == nil {
+		p.unroutable = make(map[string]int)
+	}
+	p.unroutable[m.EventName]++
+
+	log.Printf("Unroutable outbox message %s [%s], keeping it pending (%d unroutable so far): %v\n",
+		m.ID, m.EventName, p.unroutable[m.EventName], err)
+}
+
+// publisher returns Publish, or else publishes on the confirmed channel of Channels
+func (p *OutboxProcessor) publisher() (func(exchange, routingKey string, msg amqp.Publishing) error, error) {
+	if p.Publish != nil {
+		return p.Publish, nil
+	}
+
+	confirmed, err := p.confirmedPublisher()
+	if err != nil {
+		return nil, err
+	}
+	return confirmed.Publish, nil
+}
+
+func (p *OutboxProcessor) publishMessage(publish func(exchange, routingKey string, msg amqp.Publishing) error, m OutBoxMessage, body []byte) error {
+	// routing key - ignored by fanout exchange
+	routingKey := ""
+	if p.ExchangeType == amqp.ExchangeTopic {
+		routingKey = RoutingKey(m.AggregateType, m.EventName)
+	}
+
+	// The outbox ID is a stable ID consumers deduplicate on
+	now := time.Now()
+	msg := amqp.Publishing{
+		ContentType:     "application/json",
+		ContentEncoding: m.ContentEncoding,
+		MessageId:       m.ID,
+		Priority:        m.Priority,
+		Timestamp:       now,
+		Body:            body,
+	}
+	headers := amqp.Table{}
+	if p.DeduplicationHeader {
+		headers[HeaderDeduplication] = m.ID
+	}
+	// The broker drops or dead-letters the message once the per-message TTL is over
+	if m.ExpiresAt != nil {
+		msg.Expiration = queue.Expiration(*m.ExpiresAt, now)
+		headers[queue.HeaderExpiresAt] = m.ExpiresAt.UnixMilli()
+	}
+	if len(headers) > 0 {
+		msg.Headers = headers
+	}
+
+	return publish(p.Exchange, routingKey, msg)
 }
@@ -0,0 +1,241 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"gorm.io/datatypes"
+)
+
+// UnknownEventPolicy decides what happens to events without a registered handler
+type UnknownEventPolicy int
+
+const (
+	// IgnoreUnknownEvents marks unknown events as processed and moves on
+	IgnoreUnknownEvents UnknownEventPolicy = iota
+	// ParkUnknownEvents keeps unknown events in the inbox without retrying them
+	ParkUnknownEvents
+	// FailUnknownEvents counts unknown events as failed attempts, so they are retried
+	FailUnknownEvents
+)
+
+var (
+	// ErrUnknownEvent is returned when no handler is registered for an event
+	ErrUnknownEvent = errors.New("no handler registered for event")
+	// ErrParked marks a failure that retrying will not fix
+	ErrParked = errors.New("message parked")
+)
+
+// ParseUnknownEventPolicy converts "ignore", "park" or "fail" to a policy.
+// An empty string falls back to IgnoreUnknownEvents.
+func ParseUnknownEventPolicy(s string) (UnknownEventPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "ignore":
+		return IgnoreUnknownEvents, nil
+	case "park":
+		return ParkUnknownEvents, nil
+	case "fail":
+		return FailUnknownEvents, nil
+	default:
+		return IgnoreUnknownEvents, fmt.Errorf("unknown event policy %q", s)
+	}
+}
+
+// Validator is implemented by payloads that can check themselves after decoding
+type Validator interface {
+	Validate() error
+}
+
+// HandlerRegistry dispatches inbox messages to handlers registered by event name
+type HandlerRegistry struct {
+	UnknownEventPolicy UnknownEventPolicy
+	handlers           map[string]func(ctx context.Context, payload datatypes.JSON) error
+	batchHandlers      map[string]func(ctx context.Context, messages []InboxMessage) []error
+	replaySafe         map[string]bool
+	aggregates         map[string]string
+}
+
+// HandlerOption configures a handler when it is registered
+type HandlerOption func(r *HandlerRegistry, eventName string)
+
+// ReplaySafe marks the handler as safe to run again for messages it already processed,
+// which is required before its messages can be replayed
+func ReplaySafe() HandlerOption {
+	return func(r *HandlerRegistry, eventName string) {
+		r.replaySafe[eventName] = true
+	}
+}
+
+// Aggregate sets the aggregate type of the event, which is part of its topic routing key, see RoutingKey
+func Aggregate(aggregateType string) HandlerOption {
+	return func(r *HandlerRegistry, eventName string) {
+		r.aggregates[eventName] = aggregateType
+	}
+}
+
+// NewHandlerRegistry creates an empty registry using the given unknown event policy
+func NewHandlerRegistry(policy UnknownEventPolicy) *HandlerRegistry {
+	return &HandlerRegistry{
+		UnknownEventPolicy: policy,
+		handlers:           make(map[string]func(ctx context.Context, payload datatypes.JSON) error),
+		batchHandlers:      make(map[string]func(ctx context.Context, messages []InboxMessage) []error),
+		replaySafe:         make(map[string]bool),
+		aggregates:         make(map[string]string),
+	}
+}
+
+// Register subscribes fn to eventName. The payload is decoded into T and,
+// if T implements Validator, validated before fn is called.
+// Decode and validation errors park the message since retrying cannot fix them.
+func Register[T any](r *HandlerRegistry, eventName string, fn func(ctx context.Context, payload T) error, opts ...HandlerOption) {
+	r.mustNotBeRegistered(eventName)
+	for _, opt := range opts {
+		opt(r, eventName)
+	}
+
+	r.handlers[eventName] = func(ctx context.Context, payload datatypes.JSON) error {
+		v, err := decodePayload[T](eventName, payload)
+		if err != nil {
+			return err
+		}
+		return fn(ctx, v)
+	}
+}
+
+// RegisterBatch subscribes fn to eventName, handling the claimed messages of the event in bulk.
+// fn returns one error per payload, nil for payloads that succeeded, or a nil slice when all succeeded.
+// Payloads that fail to decode or validate are parked and not passed to fn.
+func RegisterBatch[T any](r *HandlerRegistry, eventName string, fn func(ctx context.Context, payloads []T) []error, opts ...HandlerOption) {
+	r.mustNotBeRegistered(eventName)
+	for _, opt := range opts {
+		opt(r, eventName)
+	}
+
+	r.batchHandlers[eventName] = func(ctx context.Context, messages []InboxMessage) []error {
+		errs := make([]error, len(messages))
+		payloads := make([]T, 0, len(messages))
+		indexes := make([]int, 0, len(messages))
+		for i, msg := range messages {
+			v, err := decodePayload[T](eventName, msg.Payload)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			payloads = append(payloads, v)
+			indexes = append(indexes, i)
+		}
+
+		if len(payloads) == 0 {
+			return errs
+		}
+
+		batchErrs := fn(ctx, payloads)
+		if batchErrs == nil {
+			return errs
+		}
+		if len(batchErrs) != len(payloads) {
+			err := fmt.Errorf("batch handler for %s returned %d results for %d payloads", eventName, len(batchErrs), len(payloads))
+			for _, i := range indexes {
+				errs[i] = err
+			}
+			return errs
+		}
+
+		for j, i := range indexes {
+			errs[i] = batchErrs[j]
+		}
+		return errs
+	}
+}
+
+// decodePayload decodes and validates a payload, parking it on failure since retrying cannot fix it
+func decodePayload[T any](eventName string, payload datatypes.JSON) (T, error) {
+	var v T
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return v, fmt.Errorf("%w: decode %s payload: %w", ErrParked, eventName, err)
+	}
+
+	if validator, ok := any(&v).(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return v, fmt.Errorf("%w: invalid %s payload: %w", ErrParked, eventName, err)
+		}
+	}
+
+	return v, nil
+}
+
+func (r *HandlerRegistry) mustNotBeRegistered(eventName string) {
+	_, single := r.handlers[eventName]
+	_, batch := r.batchHandlers[eventName]
+	if single || batch {
+		panic(fmt.Sprintf("handler for event %s already registered", eventName))
+	}
+}
+
+// HandlesBatch implements BatchHandler
+func (r *HandlerRegistry) HandlesBatch(eventName string) bool {
+	_, ok := r.batchHandlers[eventName]
+	return ok
+}
+
+// HandleBatch implements BatchHandler
+func (r *HandlerRegistry) HandleBatch(ctx context.Context, eventName string, messages []InboxMessage) []error {
+	return r.batchHandlers[eventName](ctx, messages)
+}
+
+// IsReplaySafe reports whether the handler of eventName was registered with ReplaySafe
+func (r *HandlerRegistry) IsReplaySafe(eventName string) bool {
+	return r.replaySafe[eventName]
+}
+
+// EventNames returns the sorted names of events that have a registered handler
+func (r *HandlerRegistry) EventNames() []string {
+	names := make([]string, 0, len(r.handlers)+len(r.batchHandlers))
+	for name := range r.handlers {
+		names = append(names, name)
+	}
+	for name := range r.batchHandlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RoutingKeys returns the topic routing keys of the events that have a registered handler,
+// the bindings a worker needs to receive them
+func (r *HandlerRegistry) RoutingKeys() []string {
+	names := r.EventNames()
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		keys = append(keys, RoutingKey(r.aggregates[name], name))
+	}
+	return keys
+}
+
+// HandleMessage implements MessageHandler
+func (r *HandlerRegistry) HandleMessage(ctx context.Context, eventName string, payload datatypes.JSON) error {
+	handler, ok := r.handlers[eventName]
+	if ok {
+		return handler(ctx, payload)
+	}
+
+	// Messages of batch events can still arrive one at a time, e.g. when processed on receipt
+	if batchHandler, ok := r.batchHandlers[eventName]; ok {
+		return batchHandler(ctx, []InboxMessage{{EventName: eventName, Payload: payload}})[0]
+	}
+
+	switch r.UnknownEventPolicy {
+	case ParkUnknownEvents:
+		return fmt.Errorf("%w: %w: %s", ErrParked, ErrUnknownEvent, eventName)
+	case FailUnknownEvents:
+		return fmt.Errorf("%w: %s", ErrUnknownEvent, eventName)
+	default:
+		log.Printf("Ignoring unknown event: %s\n", eventName)
+		return nil
+	}
+}
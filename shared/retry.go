@@ -0,0 +1,84 @@
+package shared
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed inbox messages are retried, and how the relay retries marking outbox messages
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts before a message is parked
+	MaxAttempts int
+	// BaseDelay is the delay after the first failed attempt, doubled after each failure
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts
+	MaxDelay time.Duration
+	// Jitter randomizes the delay by up to this fraction in either direction
+	Jitter float64
+}
+
+// DefaultRetryPolicy is used when an InboxProcessor has no retry policy set
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   10 * time.Second,
+	MaxDelay:    10 * time.Minute,
+	Jitter:      0.2,
+}
+
+// RetryPolicyFromEnv reads INBOX_MAX_ATTEMPTS, INBOX_RETRY_BASE_DELAY and INBOX_RETRY_MAX_DELAY,
+// falling back to DefaultRetryPolicy for unset values
+func RetryPolicyFromEnv() (RetryPolicy, error) {
+	policy := DefaultRetryPolicy
+
+	if v := os.Getenv("INBOX_MAX_ATTEMPTS"); v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts < 1 {
+			return policy, fmt.Errorf("invalid INBOX_MAX_ATTEMPTS %q", v)
+		}
+		policy.MaxAttempts = attempts
+	}
+
+	if v := os.Getenv("INBOX_RETRY_BASE_DELAY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return policy, fmt.Errorf("invalid INBOX_RETRY_BASE_DELAY %q: %w", v, err)
+		}
+		policy.BaseDelay = d
+	}
+
+	if v := os.Getenv("INBOX_RETRY_MAX_DELAY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return policy, fmt.Errorf("invalid INBOX_RETRY_MAX_DELAY %q: %w", v, err)
+		}
+		policy.MaxDelay = d
+	}
+
+	return policy, nil
+}
+
+// Backoff returns the delay before the next attempt after the given number of failed attempts
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	// Without MaxDelay the delay keeps doubling, short of overflowing
+	delay := p.BaseDelay
+	for i := 1; i < attempts && (p.MaxDelay <= 0 || delay < p.MaxDelay) && delay < math.MaxInt64/2; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(delay))
+	}
+
+	return delay
+}
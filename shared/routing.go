@@ -0,0 +1,34 @@
+package shared
+
+import (
+	"strings"
+	"unicode"
+)
+
+// RoutingKey returns the topic routing key of an event: the aggregate type followed by the event name
+// without the aggregate prefix, both in snake case, e.g. customer.created for Customer and CustomerCreated.
+// Events without an aggregate type are routed by their event name only.
+func RoutingKey(aggregateType, eventName string) string {
+	if aggregateType == "" {
+		return snakeCase(eventName)
+	}
+
+	action := eventName
+	if len(action) > len(aggregateType) && strings.EqualFold(action[:len(aggregateType)], aggregateType) {
+		action = action[len(aggregateType):]
+	}
+
+	return snakeCase(aggregateType) + "." + snakeCase(action)
+}
+
+func snakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,35 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+const _defaultShutdownTimeout = 30 * time.Second
+
+// ShutdownTimeoutFromEnv returns SHUTDOWN_TIMEOUT, how long a service waits for in-flight work
+// when it is asked to stop, 30s when unset
+func ShutdownTimeoutFromEnv() (time.Duration, error) {
+	v := os.Getenv("SHUTDOWN_TIMEOUT")
+	if v == "" {
+		return _defaultShutdownTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(v)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid SHUTDOWN_TIMEOUT %q", v)
+	}
+	return timeout, nil
+}
+
+// WaitDone blocks until done is closed or ctx is done, e.g. for the context returned by cron's Stop
+func WaitDone(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
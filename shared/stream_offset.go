@@ -0,0 +1,49 @@
+package shared
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// StreamOffset is the offset of the last delivery a consumer handled from a RabbitMQ stream
+type StreamOffset struct {
+	Consumer  string    `gorm:"primaryKey;size:64" json:"consumer"`
+	Stream    string    `gorm:"primaryKey;size:255" json:"stream"`
+	Offset    int64     `json:"offset"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// StreamOffsetStore saves the stream offsets of a consumer in the database, it implements queue.OffsetStore.
+// Delete the consumer's row to make it replay the stream from its configured start offset.
+type StreamOffsetStore struct {
+	DB           *gorm.DB
+	ConsumerName string
+}
+
+// LoadOffset returns the saved offset of a stream
+func (s *StreamOffsetStore) LoadOffset(stream string) (int64, bool, error) {
+	var offset StreamOffset
+	err := s.DB.Where("consumer = ? AND stream = ?", s.ConsumerName, stream).First(&offset).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return offset.Offset, true, nil
+}
+
+// SaveOffset saves the offset of a handled delivery
+func (s *StreamOffsetStore) SaveOffset(stream string, offset int64) error {
+	return s.DB.Clauses(clause.OnConflict{
+		DoUpdates: clause.AssignmentColumns([]string{"offset", "updated_at"}),
+	}).Create(&StreamOffset{
+		Consumer:  s.ConsumerName,
+		Stream:    stream,
+		Offset:    offset,
+		UpdatedAt: time.Now(),
+	}).Error
+}
@@ -0,0 +1,52 @@
+package tests
+
+import (
+	"outbox/shared"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/datatypes"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := []byte(`{"document":"` + strings.Repeat("outbox ", 1000) + `"}`)
+
+	for _, encoding := range []string{"", shared.EncodingGzip, shared.EncodingZstd} {
+		compressed, err := shared.Compress(encoding, data)
+		require.NoError(t, err, encoding)
+		if encoding != "" {
+			assert.Less(t, len(compressed), len(data), encoding)
+		}
+
+		decompressed, err := shared.Decompress(encoding, compressed)
+		require.NoError(t, err, encoding)
+		assert.Equal(t, data, decompressed, encoding)
+	}
+
+	_, err := shared.Decompress("br", data)
+	assert.Error(t, err)
+}
+
+func TestOutboxMessageCompress(t *testing.T) {
+	compression := shared.Compression{
+		Encoding:  shared.EncodingGzip,
+		Threshold: 100,
+		Events:    map[string]string{"ReportGenerated": shared.EncodingZstd, "PasswordReset": "identity"},
+	}
+
+	small := shared.OutBoxMessage{EventName: "CustomerCreated", Payload: datatypes.JSON(`{"id":"1"}`)}
+	require.NoError(t, small.Compress(compression))
+	assert.Empty(t, small.ContentEncoding)
+	assert.Equal(t, datatypes.JSON(`{"id":"1"}`), small.Payload)
+
+	large := shared.OutBoxMessage{EventName: "CustomerCreated", Payload: datatypes.JSON(`{"bio":"` + strings.Repeat("a", 200) + `"}`)}
+	require.NoError(t, large.Compress(compression))
+	assert.Equal(t, shared.EncodingGzip, large.ContentEncoding)
+	assert.Nil(t, large.Payload)
+	assert.NotEmpty(t, large.CompressedPayload)
+
+	assert.Equal(t, shared.EncodingZstd, compression.EncodingFor("ReportGenerated", 10))
+	assert.Empty(t, compression.EncodingFor("PasswordReset", 1000))
+}
@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"context"
+	"outbox/queue"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/require"
+)
+
+// startConnectionManager starts a ConnectionManager on the RabbitMQ of .local.env with a queue private
+// to the test. The test is skipped when RabbitMQ is not reachable.
+func startConnectionManager(t *testing.T) (*queue.ConnectionManager, string) {
+	t.Helper()
+
+	if err := godotenv.Load("../.local.env"); err != nil {
+		t.Fatal("Error loading .env file:", err)
+	}
+
+	conn, err := queue.CreateConnection()
+	if err != nil {
+		t.Skip("RabbitMQ is not available:", err)
+	}
+	conn.Close()
+
+	queueName := "test_" + uuid.NewString()
+	manager := &queue.ConnectionManager{
+		Topology:          queue.Topology{Queues: []queue.Queue{{Name: queueName}}},
+		MinReconnectDelay: 10 * time.Millisecond,
+		MaxReconnectDelay: 100 * time.Millisecond,
+	}
+	require.NoError(t, manager.Start())
+
+	t.Cleanup(func() {
+		if ch, err := manager.Channel(); err == nil {
+			ch.QueueDelete(queueName, false, false, false)
+		}
+		manager.Close()
+	})
+	return manager, queueName
+}
+
+func publishTestMessage(t *testing.T, manager *queue.ConnectionManager, queueName, body string) {
+	t.Helper()
+
+	ch, err := manager.Channel()
+	require.NoError(t, err)
+	require.NoError(t, ch.Publish("", queueName, false, false, amqp.Publishing{Body: []byte(body)}))
+}
+
+func receiveTestMessage(t *testing.T, received <-chan string) string {
+	t.Helper()
+
+	select {
+	case body := <-received:
+		return body
+	case <-time.After(5 * time.Second):
+		t.Fatal("No delivery received")
+		return ""
+	}
+}
+
+func TestConnectionManagerRestartsClosedConsumerChannel(t *testing.T) {
+	manager, queueName := startConnectionManager(t)
+
+	received := make(chan string, 10)
+	consumer := &queue.Consumer{Queue: queueName}
+	require.NoError(t, manager.Consume(consumer, func(d amqp.Delivery) error {
+		received <- string(d.Body)
+		return nil
+	}))
+
+	publishTestMessage(t, manager, queueName, "before")
+	require.Equal(t, "before", receiveTestMessage(t, received))
+
+	// A channel error closes the consumer channel but not the connection
+	_, err := consumer.Channel.QueueDeclarePassive("missing_"+uuid.NewString(), false, false, false, false, nil)
+	require.Error(t, err)
+
+	publishTestMessage(t, manager, queueName, "after")
+	require.Equal(t, "after", receiveTestMessage(t, received))
+}
+
+func TestConnectionManagerRestartsConsumerChannelClosedByConsumer(t *testing.T) {
+	manager, queueName := startConnectionManager(t)
+
+	received := make(chan string, 10)
+	consumer := &queue.Consumer{Queue: queueName}
+	require.NoError(t, manager.Consume(consumer, func(d amqp.Delivery) error {
+		received <- string(d.Body)
+		return nil
+	}))
+
+	// Like a stream stopping at a delivery that keeps failing
+	require.NoError(t, consumer.Channel.Close())
+
+	publishTestMessage(t, manager, queueName, "after")
+	require.Equal(t, "after", receiveTestMessage(t, received))
+}
+
+func TestConnectionManagerStopConsumingWaitsForHandlers(t *testing.T) {
+	manager, queueName := startConnectionManager(t)
+
+	received := make(chan string, 10)
+	release := make(chan struct{})
+	consumer := &queue.Consumer{Queue: queueName}
+	require.NoError(t, manager.Consume(consumer, func(d amqp.Delivery) error {
+		received <- string(d.Body)
+		<-release
+		return nil
+	}))
+
+	publishTestMessage(t, manager, queueName, "in-flight")
+	require.Equal(t, "in-flight", receiveTestMessage(t, received))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, manager.StopConsuming(ctx), context.DeadlineExceeded)
+
+	close(release)
+	require.NoError(t, manager.StopConsuming(context.Background()))
+
+	// Cancelled consumers are not restarted and receive nothing more
+	publishTestMessage(t, manager, queueName, "after")
+	select {
+	case body := <-received:
+		t.Fatalf("Received %q after StopConsuming", body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
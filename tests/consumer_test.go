@@ -0,0 +1,235 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"outbox/queue"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAcknowledger records how a delivery was settled
+type fakeAcknowledger struct {
+	acks     int
+	nacks    int
+	requeued bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks++
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacks++
+	a.requeued = requeue
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+type republished struct {
+	exchange   string
+	routingKey string
+	msg        amqp.Publishing
+}
+
+func TestDeliveryAttempts(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		want    int
+	}{
+		{"first delivery", nil, 0},
+		{"retry count", amqp.Table{queue.HeaderRetryCount: int32(2)}, 2},
+		{"quorum delivery count", amqp.Table{"x-delivery-count": int64(3)}, 3},
+		{
+			"rejected deaths",
+			amqp.Table{"x-death": []interface{}{
+				amqp.Table{"reason": "rejected", "queue": "worker", "count": int64(2)},
+				amqp.Table{"reason": "delivery_limit", "queue": "worker", "count": int64(1)},
+			}},
+			3,
+		},
+		{
+			"expired deaths in delay queues are already retries",
+			amqp.Table{
+				queue.HeaderRetryCount: int32(2),
+				"x-death": []interface{}{
+					amqp.Table{"reason": "expired", "queue": "worker.retry.5000ms", "count": int64(2)},
+					amqp.Table{"reason": "rejected", "queue": "worker", "count": int64(1)},
+				},
+			},
+			3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, queue.DeliveryAttempts(amqp.Delivery{Headers: tt.headers}))
+		})
+	}
+}
+
+func TestConsumerHandleDeliveryMaxRequeues(t *testing.T) {
+	tests := []struct {
+		name         string
+		retries      int32
+		handlerErr   error
+		publishErr   error
+		wantExchange string
+		wantKey      string
+		wantAcks     int
+		wantRequeued bool
+	}{
+		{name: "success is acked", handlerErr: nil, wantAcks: 1},
+		{name: "first failure is retried", retries: 0, handlerErr: errors.New("boom"), wantExchange: "", wantKey: "worker", wantAcks: 1},
+		{name: "last retry", retries: 2, handlerErr: errors.New("boom"), wantExchange: "", wantKey: "worker", wantAcks: 1},
+		{name: "dead-lettered after max requeues", retries: 3, handlerErr: errors.New("boom"), wantExchange: "outbox_events.dlx", wantKey: "worker", wantAcks: 1},
+		{name: "permanent failure dead-lettered at once", retries: 0, handlerErr: fmt.Errorf("%w: boom", queue.ErrPermanent), wantExchange: "outbox_events.dlx", wantKey: "worker", wantAcks: 1},
+		{name: "unconfirmed retry is requeued", retries: 0, handlerErr: errors.New("boom"), publishErr: queue.ErrConfirmTimeout, wantExchange: "", wantKey: "worker", wantRequeued: true},
+		{name: "unconfirmed dead letter is requeued", retries: 3, handlerErr: errors.New("boom"), publishErr: queue.ErrPublishNacked, wantExchange: "outbox_events.dlx", wantKey: "worker", wantRequeued: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var published []republished
+			consumer := &queue.Consumer{
+				Queue:              "worker",
+				MaxRequeues:        3,
+				DeadLetterExchange: "outbox_events.dlx",
+				Republish: func(exchange, routingKey string, msg amqp.Publishing) error {
+					published = append(published, republished{exchange, routingKey, msg})
+					return tt.publishErr
+				},
+			}
+
+			ack := &fakeAcknowledger{}
+			d := amqp.Delivery{
+				Acknowledger: ack,
+				Headers:      amqp.Table{queue.HeaderRetryCount: tt.retries},
+				Body:         []byte(`{}`),
+			}
+			consumer.HandleDelivery(d, func(amqp.Delivery) error { return tt.handlerErr })
+
+			assert.Equal(t, tt.wantAcks, ack.acks)
+			assert.Equal(t, tt.wantRequeued, ack.requeued)
+			if tt.handlerErr == nil {
+				assert.Empty(t, published)
+				return
+			}
+
+			if assert.Len(t, published, 1) {
+				assert.Equal(t, tt.wantExchange, published[0].exchange)
+				assert.Equal(t, tt.wantKey, published[0].routingKey)
+				assert.Equal(t, tt.handlerErr.Error(), published[0].msg.Headers[queue.HeaderFailureReason])
+				if tt.wantExchange == "" {
+					assert.Equal(t, tt.retries+1, published[0].msg.Headers[queue.HeaderRetryCount])
+				}
+			}
+		})
+	}
+}
+
+func TestConsumerHandleDeliveryWithoutDeadLetterExchange(t *testing.T) {
+	consumer := &queue.Consumer{
+		Queue:       "worker",
+		MaxRequeues: 1,
+		Republish: func(exchange, routingKey string, msg amqp.Publishing) error {
+			t.Fatal("nothing should be republished")
+			return nil
+		},
+	}
+
+	ack := &fakeAcknowledger{}
+	d := amqp.Delivery{Acknowledger: ack, Headers: amqp.Table{queue.HeaderRetryCount: int32(1)}}
+	consumer.HandleDelivery(d, func(amqp.Delivery) error { return errors.New("boom") })
+
+	// Rejected so the broker dead-letters it through the DLX argument of the queue, if any
+	assert.Equal(t, 1, ack.nacks)
+	assert.False(t, ack.requeued)
+}
+
+func TestConsumerRepublishExpiration(t *testing.T) {
+	expiresAt := time.Now().Add(time.Minute)
+
+	tests := []struct {
+		name        string
+		headers     amqp.Table
+		deadLetter  bool
+		wantMinTTL  int
+		wantMaxTTL  int
+		wantExpires bool
+	}{
+		{name: "without expiry", headers: amqp.Table{}},
+		{name: "time left", headers: amqp.Table{queue.HeaderExpiresAt: expiresAt.UnixMilli()}, wantExpires: true, wantMinTTL: 50000, wantMaxTTL: 60000},
+		{name: "already expired", headers: amqp.Table{queue.HeaderExpiresAt: time.Now().Add(-time.Minute).UnixMilli()}, wantExpires: true},
+		{name: "dead letter kept", headers: amqp.Table{queue.HeaderExpiresAt: expiresAt.UnixMilli()}, deadLetter: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var published amqp.Publishing
+			consumer := &queue.Consumer{
+				Queue:              "worker",
+				DeadLetterExchange: "worker.dlx",
+				Republish: func(exchange, routingKey string, msg amqp.Publishing) error {
+					published = msg
+					return nil
+				},
+			}
+
+			// The original expiration would restart on every retry
+			d := amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Headers: tt.headers, Expiration: "60000", MessageId: "outbox-1", Priority: 5}
+			if tt.deadLetter {
+				consumer.HandleDelivery(d, func(d amqp.Delivery) error { return queue.ErrPermanent })
+			} else {
+				consumer.RetryLater(d, errors.New("boom"))
+			}
+
+			assert.Equal(t, "outbox-1", published.MessageId)
+			assert.Equal(t, uint8(5), published.Priority)
+			if !tt.wantExpires {
+				assert.Empty(t, published.Expiration)
+				return
+			}
+			ttl, err := strconv.Atoi(published.Expiration)
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, ttl, tt.wantMinTTL)
+			assert.LessOrEqual(t, ttl, tt.wantMaxTTL)
+		})
+	}
+}
+
+func TestConsumerWaitForInFlightDeliveries(t *testing.T) {
+	consumer := &queue.Consumer{Queue: "worker"}
+	deliveries := make(chan amqp.Delivery)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	consumer.HandleDeliveries(deliveries, func(d amqp.Delivery) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	ack := &fakeAcknowledger{}
+	deliveries <- amqp.Delivery{Acknowledger: ack}
+	close(deliveries)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, consumer.Wait(ctx), context.DeadlineExceeded)
+
+	close(release)
+	require.NoError(t, consumer.Wait(context.Background()))
+	assert.Equal(t, 1, ack.acks)
+}
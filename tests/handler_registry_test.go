@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"outbox/customer"
+	"outbox/shared"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/datatypes"
+)
+
+func TestHandlerRegistry(t *testing.T) {
+	registry := shared.NewHandlerRegistry(shared.IgnoreUnknownEvents)
+
+	var received customer.Customer
+	shared.Register(registry, "CustomerCreated", func(ctx context.Context, c customer.Customer) error {
+		received = c
+		return nil
+	})
+
+	// Payload is decoded into the registered type
+	err := registry.HandleMessage(context.Background(), "CustomerCreated", datatypes.JSON(`{"id":"1","email":"test@example.com","name":"Test"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "test@example.com", received.Email)
+
+	// Invalid and undecodable payloads are parked
+	err = registry.HandleMessage(context.Background(), "CustomerCreated", datatypes.JSON(`{"id":"1"}`))
+	assert.True(t, errors.Is(err, shared.ErrParked))
+	err = registry.HandleMessage(context.Background(), "CustomerCreated", datatypes.JSON(`not json`))
+	assert.True(t, errors.Is(err, shared.ErrParked))
+
+	assert.Equal(t, []string{"CustomerCreated"}, registry.EventNames())
+}
+
+func TestHandlerRegistryUnknownEventPolicy(t *testing.T) {
+	payload := datatypes.JSON(`{}`)
+
+	registry := shared.NewHandlerRegistry(shared.IgnoreUnknownEvents)
+	assert.NoError(t, registry.HandleMessage(context.Background(), "Unknown", payload))
+
+	registry.UnknownEventPolicy = shared.ParkUnknownEvents
+	err := registry.HandleMessage(context.Background(), "Unknown", payload)
+	assert.True(t, errors.Is(err, shared.ErrParked))
+	assert.True(t, errors.Is(err, shared.ErrUnknownEvent))
+
+	registry.UnknownEventPolicy = shared.FailUnknownEvents
+	err = registry.HandleMessage(context.Background(), "Unknown", payload)
+	assert.False(t, errors.Is(err, shared.ErrParked))
+	assert.True(t, errors.Is(err, shared.ErrUnknownEvent))
+
+	_, err = shared.ParseUnknownEventPolicy("drop")
+	assert.Error(t, err)
+}
+
+func TestHandlerRegistryBatch(t *testing.T) {
+	registry := shared.NewHandlerRegistry(shared.IgnoreUnknownEvents)
+
+	var received []string
+	shared.RegisterBatch(registry, "CustomerCreated", func(ctx context.Context, customers []customer.Customer) []error {
+		errs := make([]error, len(customers))
+		for i, c := range customers {
+			if c.ID == "fail" {
+				errs[i] = errors.New("indexing failed")
+				continue
+			}
+			received = append(received, c.ID)
+		}
+		return errs
+	})
+
+	assert.True(t, registry.HandlesBatch("CustomerCreated"))
+	assert.False(t, registry.HandlesBatch("Unknown"))
+
+	errs := registry.HandleBatch(context.Background(), "CustomerCreated", []shared.InboxMessage{
+		{ID: "a", Payload: datatypes.JSON(`{"id":"1","email":"one@example.com"}`)},
+		{ID: "b", Payload: datatypes.JSON(`not json`)},
+		{ID: "c", Payload: datatypes.JSON(`{"id":"fail","email":"fail@example.com"}`)},
+		{ID: "d", Payload: datatypes.JSON(`{"id":"2","email":"two@example.com"}`)},
+	})
+
+	// Each message succeeds or fails on its own
+	assert.Len(t, errs, 4)
+	assert.NoError(t, errs[0])
+	assert.True(t, errors.Is(errs[1], shared.ErrParked))
+	assert.EqualError(t, errs[2], "indexing failed")
+	assert.NoError(t, errs[3])
+	assert.Equal(t, []string{"1", "2"}, received)
+
+	// Single messages of a batch event go through the batch handler
+	assert.NoError(t, registry.HandleMessage(context.Background(), "CustomerCreated", datatypes.JSON(`{"id":"3","email":"three@example.com"}`)))
+	assert.Equal(t, []string{"1", "2", "3"}, received)
+}
+
+func TestHandlerRegistryRoutingKeys(t *testing.T) {
+	registry := shared.NewHandlerRegistry(shared.IgnoreUnknownEvents)
+	noop := func(ctx context.Context, c customer.Customer) error { return nil }
+	shared.Register(registry, "CustomerCreated", noop, shared.Aggregate("customer"))
+	shared.Register(registry, "CustomerEmailChanged", noop, shared.Aggregate("Customer"))
+	shared.Register(registry, "OrderPlaced", noop)
+
+	assert.Equal(t, []string{"customer.created", "customer.email_changed", "order_placed"}, registry.RoutingKeys())
+	assert.Equal(t, "customer.created", shared.RoutingKey("customer", "CustomerCreated"))
+	assert.Equal(t, "order_line.added", shared.RoutingKey("OrderLine", "OrderLineAdded"))
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"outbox/shared"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/datatypes"
+)
+
+type orderRecordingHandler struct {
+	mu     sync.Mutex
+	events []string
+}
+
+// HandleMessage holds the first version long enough for another goroutine to try claiming the second one
+func (h *orderRecordingHandler) HandleMessage(ctx context.Context, eventName string, payload datatypes.JSON) error {
+	var v struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return err
+	}
+
+	h.record(fmt.Sprintf("start %d", v.Version))
+	if v.Version == 1 {
+		time.Sleep(50 * time.Millisecond)
+	}
+	h.record(fmt.Sprintf("end %d", v.Version))
+	return nil
+}
+
+func (h *orderRecordingHandler) record(event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, event)
+}
+
+func TestInboxProcessorHandlesOrderingKeyInOrder(t *testing.T) {
+	db := newTestDB(t)
+	handler := &orderRecordingHandler{}
+	processor := shared.InboxProcessor{
+		DB:           db,
+		Handler:      handler,
+		ConsumerName: "worker",
+		Concurrency:  2,
+		BatchSize:    1,
+		OrderingKey:  shared.PayloadIDOrderingKey,
+	}
+
+	require.NoError(t, processor.SaveMessageWithID("m1", "CustomerUpdated", datatypes.JSON(`{"id":"1","version":1}`)))
+	// Received later, so it waits for m1
+	time.Sleep(time.Millisecond)
+	require.NoError(t, processor.SaveMessageWithID("m2", "CustomerUpdated", datatypes.JSON(`{"id":"1","version":2}`)))
+
+	processor.ProcessMessages()
+
+	assert.Equal(t, []string{"start 1", "end 1", "start 2", "end 2"}, handler.events)
+
+	var processed int64
+	require.NoError(t, db.Model(&shared.InboxMessage{}).Where("status = ?", shared.InboxStatusProcessed).Count(&processed).Error)
+	assert.Equal(t, int64(2), processed)
+}
+
+func TestInboxProcessorReclaimsExpiredLease(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+	expired := now.Add(-time.Minute)
+	active := now.Add(time.Minute)
+
+	messages := []shared.InboxMessage{
+		{ID: "expired-lease", LockedUntil: &expired},
+		{ID: "active-lease", LockedUntil: &active},
+	}
+	for i := range messages {
+		messages[i].Consumer = "worker"
+		messages[i].EventName = "CustomerCreated"
+		messages[i].Payload = datatypes.JSON(`{}`)
+		messages[i].Status = shared.InboxStatusPending
+		messages[i].ProcessingCount = 1
+		messages[i].LockedBy = "other-worker"
+	}
+	require.NoError(t, db.Create(&messages).Error)
+
+	handler := &failingHandler{}
+	processor := shared.InboxProcessor{DB: db, Handler: handler, ConsumerName: "worker"}
+	processor.ProcessMessages()
+
+	assert.Equal(t, 1, handler.calls)
+
+	msg := findInboxMessage(t, db, "expired-lease")
+	assert.Equal(t, shared.InboxStatusProcessed, msg.Status)
+	assert.Equal(t, 2, msg.ProcessingCount)
+	assert.NotEqual(t, "other-worker", msg.LockedBy)
+
+	msg = findInboxMessage(t, db, "active-lease")
+	assert.Equal(t, shared.InboxStatusPending, msg.Status)
+	assert.Equal(t, 1, msg.ProcessingCount)
+	assert.Equal(t, "other-worker", msg.LockedBy)
+}
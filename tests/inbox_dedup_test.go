@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"outbox/queue"
+	"outbox/shared"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/datatypes"
+)
+
+func TestSaveMessageWithIDMatchesContentHashDuringRollout(t *testing.T) {
+	payload := datatypes.JSON(`{"id":"1","email":"test@example.com","name":"Test"}`)
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, processor *shared.InboxProcessor)
+	}{
+		{
+			name: "saved without message ID",
+			setup: func(t *testing.T, processor *shared.InboxProcessor) {
+				require.NoError(t, processor.SaveMessage("CustomerCreated", payload))
+			},
+		},
+		{
+			name: "compacted without message ID",
+			setup: func(t *testing.T, processor *shared.InboxProcessor) {
+				require.NoError(t, processor.DB.Create(&shared.InboxDedupKey{
+					ID:          shared.GenerateContentHash("CustomerCreated", "worker", payload),
+					Consumer:    "worker",
+					ProcessedAt: time.Now(),
+				}).Error)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			processor := &shared.InboxProcessor{DB: db, ConsumerName: "worker"}
+			tt.setup(t, processor)
+
+			// The same event republished by an upgraded relay with its outbox ID
+			require.NoError(t, processor.SaveMessageWithID("outbox-1", "CustomerCreated", payload))
+
+			var count int64
+			require.NoError(t, db.Model(&shared.InboxMessage{}).
+				Where("id = ?", shared.GenerateMessageIDHash("outbox-1", "worker")).
+				Count(&count).Error)
+			assert.Zero(t, count)
+		})
+	}
+}
+
+func TestSaveMessageWithIDDeduplicatesOnMessageID(t *testing.T) {
+	db := newTestDB(t)
+	processor := &shared.InboxProcessor{DB: db, ConsumerName: "worker"}
+
+	require.NoError(t, processor.SaveMessageWithID("outbox-1", "CustomerUpdated", datatypes.JSON(`{"id":"1","name":"A"}`)))
+	require.NoError(t, processor.SaveMessageWithID("outbox-1", "CustomerUpdated", datatypes.JSON(`{"id":"1","name":"B"}`)))
+	require.NoError(t, processor.SaveMessageWithID("outbox-2", "CustomerUpdated", datatypes.JSON(`{"id":"1","name":"A"}`)))
+
+	var ids []string
+	require.NoError(t, db.Model(&shared.InboxMessage{}).Order("received_at").Pluck("message_id", &ids).Error)
+	assert.ElementsMatch(t, []string{"outbox-1", "outbox-2"}, ids)
+}
+
+func TestWorkerTopologyDeduplication(t *testing.T) {
+	exchange, err := queue.OutboxExchangeOfType("fanout")
+	require.NoError(t, err)
+
+	topology := queue.WorkerTopology(queue.WorkerQueue{Name: "worker", Exchange: exchange, Deduplication: true})
+
+	require.NotEmpty(t, topology.Queues)
+	assert.Equal(t, "worker", topology.Queues[0].Name)
+	assert.Equal(t, amqp.Table{
+		"x-dead-letter-exchange":    "worker.dlx",
+		"x-dead-letter-routing-key": "worker",
+		"x-message-deduplication":   true,
+	}, topology.Queues[0].Arguments)
+}
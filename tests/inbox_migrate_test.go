@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"outbox/shared"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// legacyInboxMessage is the inbox row as it was before consumers and statuses were recorded
+type legacyInboxMessage struct {
+	ID              string `gorm:"primaryKey"`
+	EventName       string
+	Payload         datatypes.JSON
+	IsProcessed     bool
+	ProcessingCount int
+	FirstAttemptAt  *time.Time
+	LastAttemptAt   *time.Time
+	ProcessedAt     *time.Time
+}
+
+func (legacyInboxMessage) TableName() string {
+	return "inbox_messages"
+}
+
+func insertLegacyMessage(t *testing.T, db *gorm.DB, id string, payload datatypes.JSON, processed bool, attempts int) {
+	t.Helper()
+
+	require.NoError(t, db.Create(&legacyInboxMessage{
+		ID:              id,
+		EventName:       "CustomerCreated",
+		Payload:         payload,
+		IsProcessed:     processed,
+		ProcessingCount: attempts,
+	}).Error)
+}
+
+func findInboxMessage(t *testing.T, db *gorm.DB, id string) shared.InboxMessage {
+	t.Helper()
+
+	var msg shared.InboxMessage
+	require.NoError(t, db.First(&msg, "id = ?", id).Error)
+	return msg
+}
+
+func TestMigrateInboxBackfillsLegacyRows(t *testing.T) {
+	db := openTestDB(t)
+	require.NoError(t, db.AutoMigrate(&legacyInboxMessage{}))
+
+	processed := datatypes.JSON(`{"id":"customer-1"}`)
+	exhausted := datatypes.JSON(`{"id":"customer-2"}`)
+	retrying := datatypes.JSON(`{"id":"customer-3"}`)
+	processedID := shared.GenerateContentHash("CustomerCreated", "worker", processed)
+	exhaustedID := shared.GenerateContentHash("CustomerCreated", "worker2", exhausted)
+	retryingID := shared.GenerateContentHash("CustomerCreated", "worker", retrying)
+	insertLegacyMessage(t, db, processedID, processed, true, 1)
+	insertLegacyMessage(t, db, exhaustedID, exhausted, false, 3)
+	insertLegacyMessage(t, db, retryingID, retrying, false, 1)
+	insertLegacyMessage(t, db, "unknown-consumer", retrying, false, 1)
+
+	require.NoError(t, shared.MigrateInbox(db, "worker", "worker2"))
+
+	msg := findInboxMessage(t, db, processedID)
+	assert.Equal(t, "worker", msg.Consumer)
+	assert.Equal(t, shared.InboxStatusProcessed, msg.Status)
+
+	msg = findInboxMessage(t, db, exhaustedID)
+	assert.Equal(t, "worker2", msg.Consumer)
+	assert.Equal(t, shared.InboxStatusParked, msg.Status)
+	assert.NotEmpty(t, msg.LastError)
+
+	msg = findInboxMessage(t, db, retryingID)
+	assert.Equal(t, "worker", msg.Consumer)
+	assert.Equal(t, shared.InboxStatusPending, msg.Status)
+
+	msg = findInboxMessage(t, db, "unknown-consumer")
+	assert.Empty(t, msg.Consumer)
+	assert.Equal(t, shared.InboxStatusPending, msg.Status)
+}
+
+func TestMigrateInboxKeepsRetryingMessagesPending(t *testing.T) {
+	db := newTestDB(t)
+
+	msg := shared.InboxMessage{
+		ID:              "retrying",
+		Consumer:        "worker",
+		EventName:       "CustomerCreated",
+		Payload:         datatypes.JSON(`{}`),
+		Status:          shared.InboxStatusPending,
+		ProcessingCount: 3,
+		LastError:       "down",
+	}
+	require.NoError(t, db.Create(&msg).Error)
+
+	require.NoError(t, shared.MigrateInbox(db, "worker"))
+
+	msg = findInboxMessage(t, db, "retrying")
+	assert.Equal(t, shared.InboxStatusPending, msg.Status)
+	assert.Equal(t, "down", msg.LastError)
+}
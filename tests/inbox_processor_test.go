@@ -0,0 +1,204 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"outbox/shared"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/datatypes"
+)
+
+func TestInboxProcessorProcessOnReceive(t *testing.T) {
+	tests := []struct {
+		name             string
+		processOnReceive bool
+		wantCalls        int
+		wantStatus       string
+	}{
+		{"handled on receive", true, 1, shared.InboxStatusProcessed},
+		{"left to the sweep", false, 0, shared.InboxStatusPending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			handler := &failingHandler{}
+			processor := shared.InboxProcessor{
+				DB:               db,
+				Handler:          handler,
+				ConsumerName:     "worker",
+				ProcessOnReceive: tt.processOnReceive,
+			}
+
+			require.NoError(t, processor.ReceiveMessageWithID("m1", "CustomerCreated", datatypes.JSON(`{"id":"1"}`)))
+			// A redelivery is not handled again
+			require.NoError(t, processor.ReceiveMessageWithID("m1", "CustomerCreated", datatypes.JSON(`{"id":"1"}`)))
+
+			var msg shared.InboxMessage
+			require.NoError(t, db.First(&msg).Error)
+			assert.Equal(t, tt.wantCalls, handler.calls)
+			assert.Equal(t, tt.wantStatus, msg.Status)
+			assert.Equal(t, tt.wantCalls, msg.ProcessingCount)
+		})
+	}
+}
+
+// blockingHandler blocks until its context is done
+type blockingHandler struct {
+	started chan struct{}
+}
+
+func (h *blockingHandler) HandleMessage(ctx context.Context, eventName string, payload datatypes.JSON) error {
+	if h.started != nil {
+		close(h.started)
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestInboxProcessorEventTimeoutFailsAttempt(t *testing.T) {
+	db := newTestDB(t)
+	processor := shared.InboxProcessor{
+		DB:             db,
+		Handler:        &blockingHandler{},
+		ConsumerName:   "worker",
+		RetryPolicy:    shared.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour},
+		HandlerTimeout: time.Hour,
+		EventTimeouts:  map[string]time.Duration{"CustomerCreated": 10 * time.Millisecond},
+	}
+
+	require.NoError(t, processor.SaveMessageWithID("m1", "CustomerCreated", datatypes.JSON(`{"id":"1"}`)))
+	processor.ProcessMessages()
+
+	msg := findInboxMessage(t, db, shared.GenerateMessageIDHash("m1", "worker"))
+	assert.Equal(t, shared.InboxStatusPending, msg.Status)
+	assert.Equal(t, 1, msg.ProcessingCount)
+	assert.Contains(t, msg.LastError, "handler timed out after 10ms")
+	assert.NotNil(t, msg.NextAttemptAt)
+	assert.Nil(t, msg.LockedUntil)
+}
+
+type funcBatchHandler struct {
+	handleBatch func(messages []shared.InboxMessage) []error
+	calls       int
+}
+
+func (h *funcBatchHandler) HandleMessage(ctx context.Context, eventName string, payload datatypes.JSON) error {
+	return errors.New("not a batch")
+}
+
+func (h *funcBatchHandler) HandlesBatch(eventName string) bool {
+	return true
+}
+
+func (h *funcBatchHandler) HandleBatch(ctx context.Context, eventName string, messages []shared.InboxMessage) []error {
+	h.calls++
+	return h.handleBatch(messages)
+}
+
+func TestInboxProcessorRecordsBatchResults(t *testing.T) {
+	tests := []struct {
+		name        string
+		handleBatch func(messages []shared.InboxMessage) []error
+		wantStatus  map[string]string
+		wantError   string
+	}{
+		{
+			name:        "all succeeded",
+			handleBatch: func(messages []shared.InboxMessage) []error { return nil },
+			wantStatus:  map[string]string{"m1": shared.InboxStatusProcessed, "m2": shared.InboxStatusProcessed, "m3": shared.InboxStatusProcessed},
+		},
+		{
+			name: "per message errors",
+			handleBatch: func(messages []shared.InboxMessage) []error {
+				errs := make([]error, len(messages))
+				for i, msg := range messages {
+					if msg.MessageID == "m2" {
+						errs[i] = errors.New("downstream unavailable")
+					}
+				}
+				return errs
+			},
+			wantStatus: map[string]string{"m1": shared.InboxStatusProcessed, "m2": shared.InboxStatusPending, "m3": shared.InboxStatusProcessed},
+			wantError:  "downstream unavailable",
+		},
+		{
+			name:        "panic",
+			handleBatch: func(messages []shared.InboxMessage) []error { panic("boom") },
+			wantStatus:  map[string]string{"m1": shared.InboxStatusPending, "m2": shared.InboxStatusPending, "m3": shared.InboxStatusPending},
+			wantError:   "handler panicked: boom",
+		},
+		{
+			name:        "wrong number of results",
+			handleBatch: func(messages []shared.InboxMessage) []error { return []error{nil} },
+			wantStatus:  map[string]string{"m1": shared.InboxStatusPending, "m2": shared.InboxStatusPending, "m3": shared.InboxStatusPending},
+			wantError:   "returned 1 results for 3 messages",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			handler := &funcBatchHandler{handleBatch: tt.handleBatch}
+			processor := shared.InboxProcessor{
+				DB:           db,
+				Handler:      handler,
+				ConsumerName: "worker",
+				RetryPolicy:  shared.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour},
+			}
+
+			for _, id := range []string{"m1", "m2", "m3"} {
+				require.NoError(t, processor.SaveMessageWithID(id, "CustomerUpdated", datatypes.JSON(`{"id":"`+id+`"}`)))
+			}
+			processor.ProcessMessages()
+
+			assert.Equal(t, 1, handler.calls)
+			for id, wantStatus := range tt.wantStatus {
+				msg := findInboxMessage(t, db, shared.GenerateMessageIDHash(id, "worker"))
+				assert.Equal(t, wantStatus, msg.Status, id)
+				assert.Equal(t, 1, msg.ProcessingCount, id)
+				assert.Equal(t, wantStatus == shared.InboxStatusProcessed, msg.IsProcessed, id)
+				if wantStatus == shared.InboxStatusPending {
+					assert.Contains(t, msg.LastError, tt.wantError, id)
+				} else {
+					assert.Empty(t, msg.LastError, id)
+				}
+			}
+		})
+	}
+}
+
+func TestInboxProcessorShutdownReleasesInFlightMessages(t *testing.T) {
+	db := newTestDB(t)
+	handler := &blockingHandler{started: make(chan struct{})}
+	processor := shared.InboxProcessor{DB: db, Handler: handler, ConsumerName: "worker"}
+	require.NoError(t, processor.SaveMessageWithID("m1", "CustomerCreated", datatypes.JSON(`{"id":"1"}`)))
+
+	done := make(chan struct{})
+	go func() {
+		processor.ProcessMessages()
+		close(done)
+	}()
+	<-handler.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, processor.Shutdown(ctx), context.DeadlineExceeded)
+	<-done
+
+	msg := findInboxMessage(t, db, shared.GenerateMessageIDHash("m1", "worker"))
+	assert.Equal(t, shared.InboxStatusPending, msg.Status)
+	assert.Equal(t, 1, msg.ProcessingCount)
+	assert.Nil(t, msg.LockedUntil)
+	assert.Nil(t, msg.NextAttemptAt)
+	assert.Equal(t, context.Canceled.Error(), msg.LastError)
+
+	// Nothing is claimed once shutting down
+	processor.ProcessMessages()
+	msg = findInboxMessage(t, db, shared.GenerateMessageIDHash("m1", "worker"))
+	assert.Equal(t, 1, msg.ProcessingCount)
+}
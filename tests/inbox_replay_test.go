@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"context"
+	"outbox/shared"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func replayRegistry() *shared.HandlerRegistry {
+	registry := shared.NewHandlerRegistry(shared.IgnoreUnknownEvents)
+	noop := func(ctx context.Context, payload map[string]any) error { return nil }
+	shared.Register(registry, "CustomerCreated", noop, shared.ReplaySafe())
+	shared.Register(registry, "CustomerCharged", noop)
+	return registry
+}
+
+func seedReplayMessages(t *testing.T, db *gorm.DB) {
+	t.Helper()
+
+	now := time.Now()
+	errText := "downstream unavailable"
+	messages := []shared.InboxMessage{
+		{ID: "processed", Consumer: "worker", EventName: "CustomerCreated", Status: shared.InboxStatusProcessed, IsProcessed: true, ProcessingCount: 1, ProcessedAt: &now},
+		{ID: "parked", Consumer: "worker", EventName: "CustomerCreated", Status: shared.InboxStatusParked, ProcessingCount: 5, LastError: errText, ParkedAt: &now},
+		{ID: "pending", Consumer: "worker", EventName: "CustomerCreated", Status: shared.InboxStatusPending},
+		{ID: "charged", Consumer: "worker", EventName: "CustomerCharged", Status: shared.InboxStatusProcessed, IsProcessed: true, ProcessedAt: &now},
+		{ID: "other-consumer", Consumer: "worker2", EventName: "CustomerCreated", Status: shared.InboxStatusProcessed, IsProcessed: true, ProcessedAt: &now},
+	}
+	for i := range messages {
+		messages[i].Payload = []byte(`{}`)
+		messages[i].ReceivedAt = now.Add(time.Duration(i) * time.Second)
+	}
+	require.NoError(t, db.Create(&messages).Error)
+}
+
+func messageIDs(messages []shared.InboxMessage) []string {
+	ids := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+	return ids
+}
+
+func TestReplayMessagesResetsStatus(t *testing.T) {
+	db := newTestDB(t)
+	seedReplayMessages(t, db)
+
+	replayed, err := shared.ReplayMessages(db, replayRegistry(), shared.ReplayFilter{
+		Consumer:   "worker",
+		EventNames: []string{"CustomerCreated"},
+	}, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"processed", "parked"}, messageIDs(replayed))
+
+	var messages []shared.InboxMessage
+	require.NoError(t, db.Where("id IN ?", []string{"processed", "parked"}).Find(&messages).Error)
+	for _, msg := range messages {
+		assert.Equal(t, shared.InboxStatusPending, msg.Status, msg.ID)
+		assert.False(t, msg.IsProcessed, msg.ID)
+		assert.Zero(t, msg.ProcessingCount, msg.ID)
+		assert.Empty(t, msg.LastError, msg.ID)
+		assert.Nil(t, msg.ProcessedAt, msg.ID)
+		assert.Nil(t, msg.ParkedAt, msg.ID)
+	}
+
+	var other shared.InboxMessage
+	require.NoError(t, db.First(&other, "id = ?", "other-consumer").Error)
+	assert.Equal(t, shared.InboxStatusProcessed, other.Status)
+}
+
+func TestReplayMessagesDryRun(t *testing.T) {
+	db := newTestDB(t)
+	seedReplayMessages(t, db)
+
+	replayed, err := shared.ReplayMessages(db, replayRegistry(), shared.ReplayFilter{
+		Consumer: "worker",
+		IDs:      []string{"processed", "parked", "pending"},
+	}, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"processed", "parked"}, messageIDs(replayed))
+
+	var pending int64
+	require.NoError(t, db.Model(&shared.InboxMessage{}).Where("status = ?", shared.InboxStatusPending).Count(&pending).Error)
+	assert.Equal(t, int64(1), pending)
+}
+
+func TestReplayMessagesRefusesUnsafeHandlers(t *testing.T) {
+	db := newTestDB(t)
+	seedReplayMessages(t, db)
+
+	replayed, err := shared.ReplayMessages(db, replayRegistry(), shared.ReplayFilter{
+		Consumer: "worker",
+		From:     time.Now().Add(-time.Minute),
+	}, false)
+	assert.ErrorContains(t, err, "handlers of CustomerCharged are not marked replay safe")
+	assert.ElementsMatch(t, []string{"processed", "parked", "charged"}, messageIDs(replayed))
+
+	var pending int64
+	require.NoError(t, db.Model(&shared.InboxMessage{}).Where("status = ?", shared.InboxStatusPending).Count(&pending).Error)
+	assert.Equal(t, int64(1), pending)
+}
+
+func TestReplayMessagesRequiresFilter(t *testing.T) {
+	db := newTestDB(t)
+
+	_, err := shared.ReplayMessages(db, replayRegistry(), shared.ReplayFilter{}, false)
+	assert.ErrorContains(t, err, "requires a consumer")
+
+	_, err = shared.ReplayMessages(db, replayRegistry(), shared.ReplayFilter{Consumer: "worker"}, false)
+	assert.ErrorContains(t, err, "requires an event name")
+}
@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"outbox/shared"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/datatypes"
+)
+
+func TestInboxRetentionOnlyTouchesOwnRows(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+
+	messages := []shared.InboxMessage{
+		{ID: "own-old", Consumer: "worker", EventName: "CustomerCreated", Status: shared.InboxStatusProcessed, IsProcessed: true, ProcessedAt: &old},
+		{ID: "own-old-2", Consumer: "worker", EventName: "CustomerCreated", Status: shared.InboxStatusProcessed, IsProcessed: true, ProcessedAt: &old},
+		{ID: "own-expired", Consumer: "worker", EventName: "CustomerCreated", Status: shared.InboxStatusExpired, ExpiredAt: &old},
+		{ID: "own-recent", Consumer: "worker", EventName: "CustomerCreated", Status: shared.InboxStatusProcessed, IsProcessed: true, ProcessedAt: &now},
+		{ID: "own-pending", Consumer: "worker", EventName: "CustomerCreated", Status: shared.InboxStatusPending},
+		{ID: "unassigned-old", Consumer: "", EventName: "CustomerCreated", Status: shared.InboxStatusProcessed, IsProcessed: true, ProcessedAt: &old},
+		{ID: "other-old", Consumer: "worker2", EventName: "CustomerCreated", Status: shared.InboxStatusProcessed, IsProcessed: true, ProcessedAt: &old},
+	}
+	for i := range messages {
+		messages[i].ReceivedAt = old
+		messages[i].Payload = []byte(`{}`)
+	}
+	require.NoError(t, db.Create(&messages).Error)
+
+	counts, err := shared.CountInbox(db, "worker")
+	require.NoError(t, err)
+	assert.Equal(t, shared.InboxCounts{Pending: 1, Processed: 3, Expired: 1}, counts)
+
+	retention := shared.InboxRetention{DB: db, ConsumerName: "worker", Window: 24 * time.Hour, BatchSize: 2}
+	result, err := retention.Cleanup(now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), result.DeletedMessages)
+	assert.Equal(t, shared.InboxCounts{Pending: 1, Processed: 1}, result.Counts)
+
+	var left []string
+	require.NoError(t, db.Model(&shared.InboxMessage{}).Order("id").Pluck("id", &left).Error)
+	assert.Equal(t, []string{"other-old", "own-pending", "own-recent", "unassigned-old"}, left)
+}
+
+func TestInboxRetentionCompactsDedupKeys(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	processor := shared.InboxProcessor{DB: db, Handler: &failingHandler{}, ConsumerName: "worker"}
+
+	require.NoError(t, processor.SaveMessageWithID("m1", "CustomerCreated", datatypes.JSON(`{"id":"1"}`)))
+	require.NoError(t, processor.SaveMessageWithID("m2", "CustomerCreated", datatypes.JSON(`{"id":"2"}`)))
+	processor.ProcessMessages()
+	require.NoError(t, db.Model(&shared.InboxMessage{}).Where("1 = 1").Update("processed_at", old).Error)
+
+	// Left behind by an earlier run that failed after compacting
+	m2 := shared.GenerateMessageIDHash("m2", "worker")
+	require.NoError(t, db.Create(&shared.InboxDedupKey{ID: m2, Consumer: "worker", ProcessedAt: old}).Error)
+
+	retention := shared.InboxRetention{
+		DB:               db,
+		ConsumerName:     "worker",
+		Window:           24 * time.Hour,
+		CompactDedupKeys: true,
+		DedupWindow:      72 * time.Hour,
+	}
+	result, err := retention.Cleanup(now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), result.DeletedMessages)
+	assert.Equal(t, int64(1), result.CompactedKeys)
+	assert.Equal(t, shared.InboxCounts{DedupKeys: 2}, result.Counts)
+
+	// A redelivery inside the dedup window is still a duplicate
+	require.NoError(t, processor.SaveMessageWithID("m1", "CustomerCreated", datatypes.JSON(`{"id":"1"}`)))
+	counts, err := shared.CountInbox(db, "worker")
+	require.NoError(t, err)
+	assert.Equal(t, shared.InboxCounts{DedupKeys: 2}, counts)
+
+	result, err = retention.Cleanup(now.Add(72 * time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), result.ExpiredDedupKeys)
+
+	// Once the key is dropped, the message is saved again
+	require.NoError(t, processor.SaveMessageWithID("m1", "CustomerCreated", datatypes.JSON(`{"id":"1"}`)))
+	counts, err = shared.CountInbox(db, "worker")
+	require.NoError(t, err)
+	assert.Equal(t, shared.InboxCounts{Pending: 1}, counts)
+}
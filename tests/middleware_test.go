@@ -0,0 +1,52 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"outbox/shared"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/datatypes"
+)
+
+func TestMiddlewareChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) shared.Middleware {
+		return func(next shared.MessageHandler) shared.MessageHandler {
+			return shared.HandlerFunc(func(ctx context.Context, eventName string, payload datatypes.JSON) error {
+				calls = append(calls, name)
+				return next.HandleMessage(ctx, eventName, payload)
+			})
+		}
+	}
+
+	handler := shared.Chain(shared.HandlerFunc(func(context.Context, string, datatypes.JSON) error {
+		calls = append(calls, "handler")
+		return nil
+	}), trace("outer"), trace("inner"))
+
+	assert.NoError(t, handler.HandleMessage(context.Background(), "CustomerCreated", nil))
+	assert.Equal(t, []string{"outer", "inner", "handler"}, calls)
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	handler := shared.Chain(shared.HandlerFunc(func(context.Context, string, datatypes.JSON) error {
+		panic("boom")
+	}), shared.Recover())
+
+	err := handler.HandleMessage(context.Background(), "CustomerCreated", nil)
+	assert.True(t, errors.Is(err, shared.ErrHandlerPanic))
+	assert.Contains(t, err.Error(), "boom")
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	handler := shared.Chain(shared.HandlerFunc(func(context.Context, string, datatypes.JSON) error {
+		time.Sleep(time.Second)
+		return nil
+	}), shared.Timeout(10*time.Millisecond))
+
+	err := handler.HandleMessage(context.Background(), "CustomerCreated", nil)
+	assert.True(t, errors.Is(err, shared.ErrHandlerTimeout))
+}
@@ -0,0 +1,185 @@
+package tests
+
+import (
+	"errors"
+	"outbox/queue"
+	"outbox/shared"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// seedOutbox inserts pending messages m1..mN, published in that order
+func seedOutbox(t *testing.T, db *gorm.DB, n int) []string {
+	t.Helper()
+
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		id := string(rune('1' + i))
+		ids = append(ids, "m"+id)
+		require.NoError(t, db.Create(&shared.OutBoxMessage{
+			ID:            "m" + id,
+			AggregateType: "customer",
+			EventName:     "CustomerCreated",
+			Payload:       datatypes.JSON(`{"id":"` + id + `"}`),
+			Priority:      uint8(n - i),
+		}).Error)
+	}
+	return ids
+}
+
+// failOutboxUpdates makes the outbox updates fail from the given call on, for failures calls
+func failOutboxUpdates(t *testing.T, db *gorm.DB, from, failures int) *int {
+	t.Helper()
+
+	calls := 0
+	err := db.Callback().Update().Before("gorm:update").Register("test:fail_outbox_update", func(tx *gorm.DB) {
+		if tx.Statement.Table != "out_box_messages" {
+			return
+		}
+		calls++
+		if calls >= from && calls < from+failures {
+			tx.AddError(errors.New("database unavailable"))
+		}
+	})
+	require.NoError(t, err)
+	return &calls
+}
+
+func processedIDs(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+
+	var ids []string
+	require.NoError(t, db.Model(&shared.OutBoxMessage{}).Where("is_processed = ?", true).Order("id").Pluck("id", &ids).Error)
+	return ids
+}
+
+func newTestOutboxProcessor(db *gorm.DB, published *[]string) *shared.OutboxProcessor {
+	return &shared.OutboxProcessor{
+		DB:              db,
+		Exchange:        "outbox_events",
+		MarkChunkSize:   2,
+		MarkRetryPolicy: shared.RetryPolicy{MaxAttempts: 2},
+		Publish: func(exchange, routingKey string, msg amqp.Publishing) error {
+			*published = append(*published, msg.MessageId)
+			return nil
+		},
+	}
+}
+
+func TestOutboxProcessorMarksChunks(t *testing.T) {
+	db := newTestDB(t)
+	ids := seedOutbox(t, db, 5)
+	calls := failOutboxUpdates(t, db, 0, 0)
+
+	var published []string
+	newTestOutboxProcessor(db, &published).HandleOutboxMessage()
+
+	assert.Equal(t, ids, published)
+	assert.Equal(t, ids, processedIDs(t, db))
+	// Two full chunks and the rest
+	assert.Equal(t, 3, *calls)
+
+	var sent int64
+	require.NoError(t, db.Model(&shared.OutBoxMessage{}).Where("sent_at IS NOT NULL").Count(&sent).Error)
+	assert.Equal(t, int64(5), sent)
+}
+
+func TestOutboxProcessorRetriesMarking(t *testing.T) {
+	db := newTestDB(t)
+	ids := seedOutbox(t, db, 5)
+	// The second chunk fails once and succeeds on the retry
+	failOutboxUpdates(t, db, 2, 1)
+
+	var published []string
+	newTestOutboxProcessor(db, &published).HandleOutboxMessage()
+
+	assert.Equal(t, ids, published)
+	assert.Equal(t, ids, processedIDs(t, db))
+}
+
+func TestOutboxProcessorStopsWhenMarkingFails(t *testing.T) {
+	db := newTestDB(t)
+	seedOutbox(t, db, 5)
+	// The second chunk fails on every attempt
+	calls := failOutboxUpdates(t, db, 2, 2)
+
+	var published []string
+	newTestOutboxProcessor(db, &published).HandleOutboxMessage()
+
+	// Only the chunk that failed stays unmarked, and nothing is published after it
+	assert.Equal(t, []string{"m1", "m2", "m3", "m4"}, published)
+	assert.Equal(t, []string{"m1", "m2"}, processedIDs(t, db))
+	assert.Equal(t, 3, *calls)
+}
+
+func TestOutboxProcessorDropsExpiredMessages(t *testing.T) {
+	db := newTestDB(t)
+	seedOutbox(t, db, 3)
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, db.Model(&shared.OutBoxMessage{}).Where("id = ?", "m2").Update("expires_at", past).Error)
+	require.NoError(t, db.Model(&shared.OutBoxMessage{}).Where("id = ?", "m3").Update("expires_at", future).Error)
+
+	var published []string
+	newTestOutboxProcessor(db, &published).HandleOutboxMessage()
+
+	assert.Equal(t, []string{"m1", "m3"}, published)
+	assert.Equal(t, []string{"m1", "m2", "m3"}, processedIDs(t, db))
+
+	var expired shared.OutBoxMessage
+	require.NoError(t, db.First(&expired, "id = ?", "m2").Error)
+	assert.Nil(t, expired.SentAt)
+}
+
+func TestOutboxProcessorKeepsUnroutableMessagesPending(t *testing.T) {
+	db := newTestDB(t)
+	seedOutbox(t, db, 2)
+
+	processor := &shared.OutboxProcessor{
+		DB:       db,
+		Exchange: "outbox_events",
+		Publish: func(exchange, routingKey string, msg amqp.Publishing) error {
+			if msg.MessageId == "m1" {
+				return queue.ErrUnroutable
+			}
+			return nil
+		},
+	}
+	processor.HandleOutboxMessage()
+
+	assert.Equal(t, []string{"m2"}, processedIDs(t, db))
+	assert.Equal(t, map[string]int{"CustomerCreated": 1}, processor.UnroutableEvents())
+}
+
+func TestOutboxProcessorPublishesExpiration(t *testing.T) {
+	db := newTestDB(t)
+	seedOutbox(t, db, 2)
+	expiresAt := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	require.NoError(t, db.Model(&shared.OutBoxMessage{}).Where("id = ?", "m1").Update("expires_at", expiresAt).Error)
+
+	published := make(map[string]amqp.Publishing)
+	processor := &shared.OutboxProcessor{
+		DB:       db,
+		Exchange: "outbox_events",
+		Publish: func(exchange, routingKey string, msg amqp.Publishing) error {
+			published[msg.MessageId] = msg
+			return nil
+		},
+	}
+	processor.HandleOutboxMessage()
+
+	ttl, err := strconv.Atoi(published["m1"].Expiration)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute.Milliseconds(), ttl, 1000)
+	assert.Equal(t, expiresAt.UnixMilli(), published["m1"].Headers[queue.HeaderExpiresAt])
+
+	assert.Empty(t, published["m2"].Expiration)
+	assert.Nil(t, published["m2"].Headers)
+}
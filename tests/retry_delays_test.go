@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"outbox/queue"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryDelays(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []time.Duration
+		wantErr bool
+	}{
+		{name: "empty", input: "", want: nil},
+		{name: "single", input: "5s", want: []time.Duration{5 * time.Second}},
+		{name: "list", input: "5s,30s,2m", want: []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute}},
+		{name: "spaces and empty items", input: " 5s , ,30s,", want: []time.Duration{5 * time.Second, 30 * time.Second}},
+		{name: "invalid", input: "5s,soon", wantErr: true},
+		{name: "zero", input: "0s", wantErr: true},
+		{name: "negative", input: "-5s", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := queue.ParseRetryDelays(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRetryTopology(t *testing.T) {
+	tests := []struct {
+		name   string
+		delays []time.Duration
+		want   []queue.Queue
+	}{
+		{name: "no delays", delays: nil, want: nil},
+		{
+			name:   "queue per delay",
+			delays: []time.Duration{5 * time.Second, 2 * time.Minute},
+			want: []queue.Queue{
+				{
+					Name:    "worker.retry.5000ms",
+					Durable: true,
+					Arguments: amqp.Table{
+						"x-message-ttl":             int64(5000),
+						"x-dead-letter-exchange":    "",
+						"x-dead-letter-routing-key": "worker",
+					},
+				},
+				{
+					Name:    "worker.retry.120000ms",
+					Durable: true,
+					Arguments: amqp.Table{
+						"x-message-ttl":             int64(120000),
+						"x-dead-letter-exchange":    "",
+						"x-dead-letter-routing-key": "worker",
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topology := queue.RetryTopology("worker", tt.delays)
+			assert.Equal(t, tt.want, topology.Queues)
+			assert.Empty(t, topology.Exchanges)
+			assert.Empty(t, topology.Bindings)
+		})
+	}
+}
+
+func TestConsumerRetryLaterUsesDelayQueues(t *testing.T) {
+	var routingKeys []string
+	consumer := &queue.Consumer{
+		Queue:       "worker",
+		RetryDelays: []time.Duration{5 * time.Second, 30 * time.Second},
+		Republish: func(exchange, routingKey string, msg amqp.Publishing) error {
+			routingKeys = append(routingKeys, routingKey)
+			return nil
+		},
+	}
+
+	for retries := int32(0); retries < 4; retries++ {
+		d := amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Headers: amqp.Table{queue.HeaderRetryCount: retries}}
+		consumer.RetryLater(d, assert.AnError)
+	}
+
+	// The last delay is reused once the delays are used up
+	assert.Equal(t, []string{"worker.retry.5000ms", "worker.retry.30000ms", "worker.retry.30000ms", "worker.retry.30000ms"}, routingKeys)
+}
+
+func TestConsumerRetryLaterRequeuesUnroutableRetry(t *testing.T) {
+	consumer := &queue.Consumer{
+		Queue:       "worker",
+		RetryDelays: []time.Duration{5 * time.Second},
+		Republish: func(exchange, routingKey string, msg amqp.Publishing) error {
+			return queue.ErrUnroutable
+		},
+	}
+
+	ack := &fakeAcknowledger{}
+	consumer.RetryLater(amqp.Delivery{Acknowledger: ack}, assert.AnError)
+
+	assert.Zero(t, ack.acks)
+	assert.True(t, ack.requeued)
+}
@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"outbox/shared"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   shared.RetryPolicy
+		attempts int
+		want     time.Duration
+	}{
+		{"first attempt", shared.RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}, 1, time.Second},
+		{"attempts below one", shared.RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}, 0, time.Second},
+		{"doubles", shared.RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}, 4, 8 * time.Second},
+		{"capped", shared.RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}, 4, 5 * time.Second},
+		{"uncapped doubles", shared.RetryPolicy{BaseDelay: time.Second}, 4, 8 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.Backoff(tt.attempts))
+		})
+	}
+}
+
+func TestRetryPolicyBackoffDoesNotOverflow(t *testing.T) {
+	policy := shared.RetryPolicy{BaseDelay: time.Second}
+	assert.Positive(t, policy.Backoff(1000))
+}
+
+func TestRetryPolicyBackoffJitter(t *testing.T) {
+	policy := shared.RetryPolicy{BaseDelay: 10 * time.Second, MaxDelay: time.Minute, Jitter: 0.2}
+	for i := 0; i < 100; i++ {
+		delay := policy.Backoff(1)
+		assert.GreaterOrEqual(t, delay, 8*time.Second)
+		assert.LessOrEqual(t, delay, 12*time.Second)
+	}
+}
+
+func TestRetryPolicyFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    shared.RetryPolicy
+		wantErr string
+	}{
+		{name: "defaults", want: shared.DefaultRetryPolicy},
+		{
+			name: "overrides",
+			env:  map[string]string{"INBOX_MAX_ATTEMPTS": "3", "INBOX_RETRY_BASE_DELAY": "1s", "INBOX_RETRY_MAX_DELAY": "1m"},
+			want: shared.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute, Jitter: shared.DefaultRetryPolicy.Jitter},
+		},
+		{name: "invalid attempts", env: map[string]string{"INBOX_MAX_ATTEMPTS": "0"}, wantErr: "INBOX_MAX_ATTEMPTS"},
+		{name: "invalid base delay", env: map[string]string{"INBOX_RETRY_BASE_DELAY": "soon"}, wantErr: "INBOX_RETRY_BASE_DELAY"},
+		{name: "invalid max delay", env: map[string]string{"INBOX_RETRY_MAX_DELAY": "later"}, wantErr: "INBOX_RETRY_MAX_DELAY"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"INBOX_MAX_ATTEMPTS", "INBOX_RETRY_BASE_DELAY", "INBOX_RETRY_MAX_DELAY"} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			got, err := shared.RetryPolicyFromEnv()
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+type failingHandler struct {
+	err   error
+	calls int
+}
+
+func (h *failingHandler) HandleMessage(ctx context.Context, eventName string, payload datatypes.JSON) error {
+	h.calls++
+	return h.err
+}
+
+func TestInboxProcessorParksAfterMaxAttempts(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		wantCalls    int
+		wantStatus   string
+		wantAttempts int
+	}{
+		{"retried until max attempts", errors.New("downstream unavailable"), 3, shared.InboxStatusParked, 3},
+		{"permanent error parked at once", shared.ErrParked, 1, shared.InboxStatusParked, 1},
+		{"success", nil, 1, shared.InboxStatusProcessed, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			handler := &failingHandler{err: tt.err}
+			processor := shared.InboxProcessor{
+				DB:           db,
+				Handler:      handler,
+				ConsumerName: "worker",
+				// No delay, so a single run retries until the message is parked
+				RetryPolicy: shared.RetryPolicy{MaxAttempts: 3},
+			}
+
+			require.NoError(t, processor.SaveMessageWithID("m1", "CustomerCreated", datatypes.JSON(`{"id":"1"}`)))
+			processor.ProcessMessages()
+
+			var msg shared.InboxMessage
+			require.NoError(t, db.First(&msg).Error)
+			assert.Equal(t, tt.wantCalls, handler.calls)
+			assert.Equal(t, tt.wantStatus, msg.Status)
+			assert.Equal(t, tt.wantAttempts, msg.ProcessingCount)
+			if tt.err != nil {
+				assert.Equal(t, tt.err.Error(), msg.LastError)
+				assert.NotNil(t, msg.ParkedAt)
+			}
+		})
+	}
+}
+
+type reclaimingHandler struct {
+	db *gorm.DB
+}
+
+// HandleMessage simulates the lease running out and another worker claiming the message meanwhile
+func (h *reclaimingHandler) HandleMessage(ctx context.Context, eventName string, payload datatypes.JSON) error {
+	return h.db.Model(&shared.InboxMessage{}).Where("1 = 1").Updates(map[string]interface{}{
+		"locked_by":        "other-worker",
+		"processing_count": gorm.Expr("processing_count + 1"),
+	}).Error
+}
+
+func TestInboxProcessorKeepsResultOfNewerClaim(t *testing.T) {
+	db := newTestDB(t)
+	processor := shared.InboxProcessor{
+		DB:           db,
+		Handler:      &reclaimingHandler{db: db},
+		ConsumerName: "worker",
+	}
+
+	require.NoError(t, processor.SaveMessageWithID("m1", "CustomerCreated", datatypes.JSON(`{"id":"1"}`)))
+	processor.ProcessMessages()
+
+	var msg shared.InboxMessage
+	require.NoError(t, db.First(&msg).Error)
+	assert.Equal(t, shared.InboxStatusPending, msg.Status)
+	assert.False(t, msg.IsProcessed)
+	assert.Equal(t, "other-worker", msg.LockedBy)
+	assert.NotNil(t, msg.LockedUntil)
+}
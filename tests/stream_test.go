@@ -0,0 +1,229 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"outbox/queue"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryOffsetStore struct {
+	offsets map[string]int64
+}
+
+func (s *memoryOffsetStore) LoadOffset(stream string) (int64, bool, error) {
+	offset, ok := s.offsets[stream]
+	return offset, ok, nil
+}
+
+func (s *memoryOffsetStore) SaveOffset(stream string, offset int64) error {
+	s.offsets[stream] = offset
+	return nil
+}
+
+func TestParseStreamOffset(t *testing.T) {
+	timestamp := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		input   string
+		want    interface{}
+		wantErr bool
+	}{
+		{input: "", want: "next"},
+		{input: "first", want: "first"},
+		{input: "last", want: "last"},
+		{input: "next", want: "next"},
+		{input: "42", want: int64(42)},
+		{input: "2024-01-02T03:04:05Z", want: timestamp},
+		{input: "-1", wantErr: true},
+		{input: "yesterday", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := queue.ParseStreamOffset(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWorkerTopologyQueueArguments(t *testing.T) {
+	exchange, err := queue.OutboxExchangeOfType("fanout")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		queue      queue.WorkerQueue
+		want       amqp.Table
+		wantQueues int
+	}{
+		{
+			name:       "classic",
+			queue:      queue.WorkerQueue{RetryDelays: []time.Duration{5 * time.Second}},
+			want:       amqp.Table{"x-dead-letter-exchange": "worker.dlx", "x-dead-letter-routing-key": "worker"},
+			wantQueues: 3,
+		},
+		{
+			name:       "priority",
+			queue:      queue.WorkerQueue{MaxPriority: 10},
+			want:       amqp.Table{"x-dead-letter-exchange": "worker.dlx", "x-dead-letter-routing-key": "worker", "x-max-priority": int32(10)},
+			wantQueues: 2,
+		},
+		{
+			name:  "quorum",
+			queue: queue.WorkerQueue{Type: queue.QueueTypeQuorum, DeliveryLimit: 5},
+			want: amqp.Table{
+				"x-dead-letter-exchange":    "worker.dlx",
+				"x-dead-letter-routing-key": "worker",
+				"x-queue-type":              "quorum",
+				"x-delivery-limit":          int32(5),
+			},
+			wantQueues: 2,
+		},
+		{
+			name:       "stream without delay queues",
+			queue:      queue.WorkerQueue{Type: queue.QueueTypeStream, RetryDelays: []time.Duration{5 * time.Second}},
+			want:       amqp.Table{"x-queue-type": "stream"},
+			wantQueues: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.queue.Name = "worker"
+			tt.queue.Exchange = exchange
+
+			topology := queue.WorkerTopology(tt.queue)
+			require.Len(t, topology.Queues, tt.wantQueues)
+			assert.Equal(t, "worker", topology.Queues[0].Name)
+			assert.Equal(t, tt.want, topology.Queues[0].Arguments)
+		})
+	}
+}
+
+func TestConsumerConfigureFromEnvQueueType(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "classic defaults", env: map[string]string{}},
+		{name: "classic priority", env: map[string]string{"CONSUMER_MAX_PRIORITY": "10", "CONSUMER_DEDUPLICATION": "true"}},
+		{name: "quorum delivery limit", env: map[string]string{"CONSUMER_QUEUE_TYPE": "quorum", "CONSUMER_DELIVERY_LIMIT": "5"}},
+		{name: "stream offset", env: map[string]string{"CONSUMER_QUEUE_TYPE": "stream", "CONSUMER_STREAM_OFFSET": "first"}},
+		{name: "unknown type", env: map[string]string{"CONSUMER_QUEUE_TYPE": "lazy"}, wantErr: "invalid CONSUMER_QUEUE_TYPE"},
+		{name: "quorum priority", env: map[string]string{"CONSUMER_QUEUE_TYPE": "quorum", "CONSUMER_MAX_PRIORITY": "10"}, wantErr: "CONSUMER_MAX_PRIORITY"},
+		{name: "stream deduplication", env: map[string]string{"CONSUMER_QUEUE_TYPE": "stream", "CONSUMER_DEDUPLICATION": "true"}, wantErr: "CONSUMER_DEDUPLICATION"},
+		{name: "classic delivery limit", env: map[string]string{"CONSUMER_DELIVERY_LIMIT": "5"}, wantErr: "CONSUMER_DELIVERY_LIMIT"},
+		{name: "quorum stream offset", env: map[string]string{"CONSUMER_QUEUE_TYPE": "quorum", "CONSUMER_STREAM_OFFSET": "first"}, wantErr: "CONSUMER_STREAM_OFFSET"},
+		{name: "invalid stream offset", env: map[string]string{"CONSUMER_QUEUE_TYPE": "stream", "CONSUMER_STREAM_OFFSET": "yesterday"}, wantErr: "CONSUMER_STREAM_OFFSET"},
+	}
+
+	names := []string{"CONSUMER_QUEUE_TYPE", "CONSUMER_MAX_PRIORITY", "CONSUMER_DELIVERY_LIMIT", "CONSUMER_STREAM_OFFSET", "CONSUMER_DEDUPLICATION"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range names {
+				t.Setenv(name, tt.env[name])
+			}
+
+			consumer := &queue.Consumer{Queue: "worker"}
+			err := consumer.ConfigureFromEnv()
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestConsumerHandleStreamDelivery(t *testing.T) {
+	transient := errors.New("database unavailable")
+	permanent := fmt.Errorf("%w: decode message: invalid character", queue.ErrPermanent)
+
+	tests := []struct {
+		name           string
+		errs           []error
+		wantCalls      int
+		wantAcked      bool
+		wantOffset     bool
+		wantDeadLetter bool
+	}{
+		{name: "handled", errs: []error{nil}, wantCalls: 1, wantAcked: true, wantOffset: true},
+		{name: "transient failure retried in place", errs: []error{transient, transient, nil}, wantCalls: 3, wantAcked: true, wantOffset: true},
+		{name: "permanent failure dead-lettered", errs: []error{permanent}, wantCalls: 1, wantAcked: true, wantOffset: true, wantDeadLetter: true},
+		{name: "transient failures exhausted", errs: []error{transient, transient, transient}, wantCalls: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var published []republished
+			offsets := &memoryOffsetStore{offsets: map[string]int64{}}
+			consumer := &queue.Consumer{
+				Queue:              "events",
+				QueueType:          queue.QueueTypeStream,
+				MaxRequeues:        2,
+				RetryDelays:        []time.Duration{time.Millisecond},
+				DeadLetterExchange: "events.dlx",
+				Offsets:            offsets,
+				Republish: func(exchange, routingKey string, msg amqp.Publishing) error {
+					published = append(published, republished{exchange, routingKey, msg})
+					return nil
+				},
+			}
+
+			calls := 0
+			ack := &fakeAcknowledger{}
+			d := amqp.Delivery{Acknowledger: ack, Headers: amqp.Table{queue.HeaderStreamOffset: int64(7)}}
+			consumer.HandleDelivery(d, func(amqp.Delivery) error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+
+			assert.Equal(t, tt.wantCalls, calls)
+			assert.Equal(t, tt.wantAcked, ack.acks == 1)
+			assert.Zero(t, ack.nacks)
+			_, saved := offsets.offsets["events"]
+			assert.Equal(t, tt.wantOffset, saved)
+
+			if tt.wantDeadLetter {
+				require.Len(t, published, 1)
+				assert.Equal(t, "events.dlx", published[0].exchange)
+			} else {
+				assert.Empty(t, published)
+			}
+		})
+	}
+}
+
+func TestConsumerHandleStreamDeliveryUnconfirmedDeadLetter(t *testing.T) {
+	offsets := &memoryOffsetStore{offsets: map[string]int64{}}
+	consumer := &queue.Consumer{
+		Queue:              "events",
+		QueueType:          queue.QueueTypeStream,
+		DeadLetterExchange: "events.dlx",
+		Offsets:            offsets,
+		Republish: func(exchange, routingKey string, msg amqp.Publishing) error {
+			return queue.ErrConfirmTimeout
+		},
+	}
+
+	ack := &fakeAcknowledger{}
+	d := amqp.Delivery{Acknowledger: ack, Headers: amqp.Table{queue.HeaderStreamOffset: int64(7)}}
+	consumer.HandleDelivery(d, func(amqp.Delivery) error { return queue.ErrPermanent })
+
+	// The offset is not advanced past a delivery that was not dead-lettered
+	assert.Zero(t, ack.acks)
+	assert.Empty(t, offsets.offsets)
+}
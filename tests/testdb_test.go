@@ -0,0 +1,38 @@
+package tests
+
+import (
+	"fmt"
+	"outbox/shared"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDB returns an in-memory SQLite database with the inbox and outbox tables, private to the test
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db := openTestDB(t)
+	require.NoError(t, shared.MigrateInbox(db))
+	require.NoError(t, db.AutoMigrate(&shared.OutBoxMessage{}))
+	return db
+}
+
+// openTestDB returns an empty in-memory SQLite database, private to the test
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	require.NoError(t, err)
+
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	// One connection keeps the in-memory database alive and avoids SQLite lock errors
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
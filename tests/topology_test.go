@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"outbox/queue"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelayTopologyDeclaresNoQueue(t *testing.T) {
+	for _, exchangeType := range []string{"fanout", "topic"} {
+		t.Run(exchangeType, func(t *testing.T) {
+			exchange, err := queue.OutboxExchangeOfType(exchangeType)
+			require.NoError(t, err)
+
+			// Without a catch-all queue, events no worker is bound for are returned to the relay
+			topology := queue.RelayTopology(exchange)
+			assert.Equal(t, []queue.Exchange{exchange}, topology.Exchanges)
+			assert.Empty(t, topology.Queues)
+			assert.Empty(t, topology.Bindings)
+		})
+	}
+}
+
+func TestWorkerTopologyBindings(t *testing.T) {
+	tests := []struct {
+		exchangeType string
+		want         []queue.Binding
+	}{
+		{
+			exchangeType: "fanout",
+			want:         []queue.Binding{{Queue: "worker", Exchange: queue.OutboxExchange}},
+		},
+		{
+			exchangeType: "topic",
+			want: []queue.Binding{
+				{Queue: "worker", Exchange: queue.OutboxTopicExchange, RoutingKey: "customer.created"},
+				{Queue: "worker", Exchange: queue.OutboxTopicExchange, RoutingKey: "customer.deleted"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.exchangeType, func(t *testing.T) {
+			exchange, err := queue.OutboxExchangeOfType(tt.exchangeType)
+			require.NoError(t, err)
+
+			topology := queue.WorkerTopology(queue.WorkerQueue{
+				Name:        "worker",
+				Exchange:    exchange,
+				RoutingKeys: []string{"customer.created", "customer.deleted"},
+			})
+
+			var outboxBindings []queue.Binding
+			for _, binding := range topology.Bindings {
+				if binding.Exchange == exchange.Name {
+					outboxBindings = append(outboxBindings, binding)
+				}
+			}
+			assert.Equal(t, tt.want, outboxBindings)
+		})
+	}
+}